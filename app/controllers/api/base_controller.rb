@@ -5,5 +5,13 @@ module Api
     include ::Errors::ErrorHandler
     respond_to :json
     protect_from_forgery with: :null_session, if: -> { request.format.json? }
+    before_action :set_trace_context
+
+    private
+
+    def set_trace_context
+      Current.request_id = request.request_id
+      Current.traceparent = TraceContext.traceparent_for(request)
+    end
   end
 end
@@ -0,0 +1,6 @@
+# frozen_string_literal: true
+
+# Per-request attributes, reset by Rails after every request.
+class Current < ActiveSupport::CurrentAttributes
+  attribute :request_id, :traceparent
+end
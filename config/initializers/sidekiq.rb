@@ -1,7 +1,13 @@
 Sidekiq.configure_server do |config|
   config.redis = { namespace: 'instachat', url: AppConfig.redis['url'] }
+  config.client_middleware do |chain|
+    chain.add TraceContext::SidekiqMiddleware
+  end
 end
 
 Sidekiq.configure_client do |config|
   config.redis = { namespace: 'instachat', url: AppConfig.redis['url'] }
+  config.client_middleware do |chain|
+    chain.add TraceContext::SidekiqMiddleware
+  end
 end
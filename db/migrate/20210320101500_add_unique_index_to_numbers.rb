@@ -0,0 +1,10 @@
+# frozen_string_literal: true
+
+# The Go workers insert chats and messages with ON DUPLICATE KEY UPDATE, so
+# a retried job finds its row already there instead of adding it again.
+class AddUniqueIndexToNumbers < ActiveRecord::Migration[5.2]
+  def change
+    add_index :chats, %i[application_id number], unique: true
+    add_index :messages, %i[chat_id number], unique: true
+  end
+end
@@ -10,7 +10,7 @@
 #
 # It's strongly recommended that you check this file into your version control system.
 
-ActiveRecord::Schema.define(version: 2021_03_17_093104) do
+ActiveRecord::Schema.define(version: 2021_03_20_101500) do
 
   create_table "applications", options: "ENGINE=InnoDB DEFAULT CHARSET=latin1", force: :cascade do |t|
     t.string "name", null: false
@@ -29,6 +29,7 @@ ActiveRecord::Schema.define(version: 2021_03_17_093104) do
     t.datetime "created_at", null: false
     t.datetime "updated_at", null: false
     t.integer "lock_version"
+    t.index ["application_id", "number"], name: "index_chats_on_application_id_and_number", unique: true
     t.index ["application_id"], name: "index_chats_on_application_id"
     t.index ["number"], name: "index_chats_on_number"
   end
@@ -39,6 +40,7 @@ ActiveRecord::Schema.define(version: 2021_03_17_093104) do
     t.datetime "updated_at", null: false
     t.bigint "chat_id"
     t.string "number"
+    t.index ["chat_id", "number"], name: "index_messages_on_chat_id_and_number", unique: true
     t.index ["chat_id"], name: "index_messages_on_chat_id"
   end
 
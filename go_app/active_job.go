@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// Class of every job enqueued through ActiveJob's Sidekiq adapter; the real
+// job class is in `wrapped` and its arguments in args[0]["arguments"].
+const activeJobWrapper = "ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper"
+
+// activeJobPayload is the serialized ActiveJob in args[0] of a wrapper job.
+type activeJobPayload struct {
+	JobClass  string          `json:"job_class"`
+	JobID     string          `json:"job_id"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// Keys ActiveJob adds to serialized hashes to restore them on the Ruby
+// side; they are not arguments.
+var activeJobReservedKeys = []string{
+	"_aj_symbol_keys",
+	"_aj_ruby2_keywords",
+	"_aj_hash_with_indifferent_access",
+}
+
+var globalIDPattern = regexp.MustCompile(`^gid://[^/]+/[^/]+/(.+)$`)
+
+// workerClass is the class the job is dispatched by: the wrapped class of
+// an ActiveJob wrapper, or else the job's own.
+func (job *Job) workerClass() string {
+	if job.Class != activeJobWrapper {
+		return job.Class
+	}
+	if job.Wrapped != "" {
+		return job.Wrapped
+	}
+	if unwrapped, err := UnwrapActiveJob(*job); err == nil && unwrapped.Class != "" {
+		return unwrapped.Class
+	}
+	return job.Class
+}
+
+// UnwrapActiveJob returns the job an ActiveJob wrapper carries, with the
+// real class and deserialized arguments, so it is dispatched to the same Go
+// worker as a plain Sidekiq job. Other jobs are returned unchanged.
+func UnwrapActiveJob(job Job) (Job, error) {
+	if job.Class != activeJobWrapper {
+		return job, nil
+	}
+	if len(job.Args) != 1 {
+		return job, &ArgumentError{Class: job.Class, Reason: "expected one serialized ActiveJob"}
+	}
+
+	var payload activeJobPayload
+	if err := json.Unmarshal(job.Args[0], &payload); err != nil {
+		return job, &ArgumentError{Class: job.Class, Reason: err.Error()}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload.Arguments))
+	decoder.UseNumber()
+	var arguments []interface{}
+	if err := decoder.Decode(&arguments); err != nil {
+		return job, &ArgumentError{Class: job.Class, Reason: err.Error()}
+	}
+
+	args := make([]json.RawMessage, len(arguments))
+	for i, argument := range arguments {
+		raw, err := dumpJSON(deserializeActiveJobArg(argument))
+		if err != nil {
+			return job, err
+		}
+		args[i] = raw
+	}
+
+	job.Class = job.Wrapped
+	if job.Class == "" {
+		job.Class = payload.JobClass
+	}
+	job.Args = args
+	return job, nil
+}
+
+// deserializeActiveJobArg undoes ActiveJob's argument serialization:
+// GlobalIDs become the record id, `_aj_serialized` values their plain
+// value, and the bookkeeping keys of hashes are dropped.
+func deserializeActiveJobArg(arg interface{}) interface{} {
+	switch arg := arg.(type) {
+	case []interface{}:
+		for i, item := range arg {
+			arg[i] = deserializeActiveJobArg(item)
+		}
+		return arg
+
+	case map[string]interface{}:
+		if gid, ok := arg["_aj_globalid"].(string); ok {
+			return globalIDModelID(gid)
+		}
+		if _, ok := arg["_aj_serialized"]; ok {
+			return deserializeActiveJobArg(arg["value"])
+		}
+
+		for _, key := range activeJobReservedKeys {
+			delete(arg, key)
+		}
+		for key, value := range arg {
+			arg[key] = deserializeActiveJobArg(value)
+		}
+		return arg
+	}
+	return arg
+}
+
+// globalIDModelID extracts the id from "gid://instachat/Chat/5", keeping
+// numeric ids as numbers.
+func globalIDModelID(gid string) interface{} {
+	match := globalIDPattern.FindStringSubmatch(gid)
+	if match == nil {
+		return gid
+	}
+
+	id := match[1]
+	if strings.Trim(id, "0123456789") == "" {
+		return json.Number(id)
+	}
+	return id
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUnwrapActiveJob(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		class   string
+		args    string
+		err     bool
+	}{
+		{
+			name:    "plain sidekiq job",
+			payload: `{"class":"MessageCreationWorker","args":[1,"hi",2]}`,
+			class:   "MessageCreationWorker",
+			args:    `[1,"hi",2]`,
+		},
+		{
+			name: "keyword arguments",
+			payload: `{"class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","wrapped":"ChatCreationJob","args":[` +
+				`{"job_class":"ChatCreationJob","job_id":"x","arguments":[{"application_id":5,"chat_number":9007199254740993,"_aj_ruby2_keywords":["application_id","chat_number"]}]}]}`,
+			class: "ChatCreationJob",
+			args:  `[{"application_id":5,"chat_number":9007199254740993}]`,
+		},
+		{
+			name: "symbol keys and global ids",
+			payload: `{"class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","args":[` +
+				`{"job_class":"MessageCreationJob","arguments":[{"chat_id":{"_aj_globalid":"gid://instachat/Chat/12"},"text":"hi","number":3,"_aj_symbol_keys":["chat_id","text","number"]}]}]}`,
+			class: "MessageCreationJob",
+			args:  `[{"chat_id":12,"number":3,"text":"hi"}]`,
+		},
+		{
+			name: "serialized values and non-numeric ids",
+			payload: `{"class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","wrapped":"SomeJob","args":[` +
+				`{"job_class":"SomeJob","arguments":[{"_aj_serialized":"ActiveJob::Serializers::SymbolSerializer","value":"fast"},{"_aj_globalid":"gid://instachat/User/ab-1"}]}]}`,
+			class: "SomeJob",
+			args:  `["fast","ab-1"]`,
+		},
+		{
+			name:    "missing serialized job",
+			payload: `{"class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","args":[]}`,
+			err:     true,
+		},
+		{
+			name:    "unreadable serialized job",
+			payload: `{"class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","args":["oops"]}`,
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		var job Job
+		if err := json.Unmarshal([]byte(test.payload), &job); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		unwrapped, err := UnwrapActiveJob(job)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: UnwrapActiveJob succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		args, _ := dumpJSON(unwrapped.Args)
+		if unwrapped.Class != test.class || string(args) != test.args {
+			t.Errorf("%s: UnwrapActiveJob = %s %s, want %s %s", test.name, unwrapped.Class, args, test.class, test.args)
+		}
+	}
+}
+
+func TestUnwrapActiveJobDecodesArgs(t *testing.T) {
+	var job Job
+	payload := `{"class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","wrapped":"MessageCreationJob","args":[` +
+		`{"job_class":"MessageCreationJob","arguments":[{"chat_id":{"_aj_globalid":"gid://instachat/Chat/12"},"text":"hi","number":3}]}]}`
+	if err := json.Unmarshal([]byte(payload), &job); err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := UnwrapActiveJob(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var args MessageCreationArgs
+	if err := DecodeArgs(unwrapped, &args); err != nil {
+		t.Fatal(err)
+	}
+	if args != (MessageCreationArgs{ChatID: 12, Text: "hi", Number: 3}) {
+		t.Errorf("DecodeArgs = %+v", args)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArgumentError reports job arguments that do not match the schema of the
+// job class. It fails the job like any other error.
+type ArgumentError struct {
+	Class  string
+	Field  string
+	Reason string
+}
+
+func (err *ArgumentError) Error() string {
+	if err.Field == "" {
+		return fmt.Sprintf("invalid arguments for %s: %s", err.Class, err.Reason)
+	}
+	return fmt.Sprintf("invalid argument %s for %s: %s", err.Field, err.Class, err.Reason)
+}
+
+// ArgsValidator can be implemented by an argument struct to check values
+// once they are decoded.
+type ArgsValidator interface {
+	Validate() error
+}
+
+// argField is one field of an argument schema, read from a struct tag like
+// `arg:"chat_id"` or `arg:"text,optional"`. Positional arguments follow the
+// order the fields are declared in.
+type argField struct {
+	name     string
+	index    int
+	optional bool
+}
+
+func argSchema(t reflect.Type) []argField {
+	var fields []argField
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("arg")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		field := argField{name: parts[0], index: i}
+		for _, option := range parts[1:] {
+			if option == "optional" {
+				field.optional = true
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// DecodeArgs fills the struct target points to from the job's arguments,
+// using its `arg` tags as the schema. Arguments are either positional,
+// as in `perform_async(chat.id, text, number)`, or a single hash of named
+// arguments, as in `perform_async(chat_id: chat.id, ...)`. Integers are
+// decoded from the raw JSON so bigint ids keep their full precision.
+func DecodeArgs(job Job, target interface{}) error {
+	value := reflect.ValueOf(target).Elem()
+	fields := argSchema(value.Type())
+
+	raw := make(map[string]json.RawMessage)
+	if named, ok := namedArgs(job.Args, fields); ok {
+		raw = named
+	} else {
+		if len(job.Args) > len(fields) {
+			return &ArgumentError{Class: job.Class, Reason: fmt.Sprintf("expected at most %d arguments, got %d", len(fields), len(job.Args))}
+		}
+		for i, arg := range job.Args {
+			raw[fields[i].name] = arg
+		}
+	}
+
+	for _, field := range fields {
+		arg, ok := raw[field.name]
+		if !ok || bytes.Equal(arg, []byte("null")) {
+			if field.optional {
+				continue
+			}
+			return &ArgumentError{Class: job.Class, Field: field.name, Reason: "is missing"}
+		}
+
+		if err := decodeArg(arg, value.Field(field.index)); err != nil {
+			return &ArgumentError{Class: job.Class, Field: field.name, Reason: err.Error()}
+		}
+	}
+
+	if validator, ok := target.(ArgsValidator); ok {
+		if err := validator.Validate(); err != nil {
+			return &ArgumentError{Class: job.Class, Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// namedArgs returns the keys of a single hash argument when the schema has
+// more than one field, or when its only field is not itself a hash.
+func namedArgs(args []json.RawMessage, fields []argField) (map[string]json.RawMessage, bool) {
+	if len(args) != 1 || !bytes.HasPrefix(bytes.TrimSpace(args[0]), []byte("{")) {
+		return nil, false
+	}
+
+	var named map[string]json.RawMessage
+	if err := json.Unmarshal(args[0], &named); err != nil {
+		return nil, false
+	}
+	if len(fields) == 1 {
+		if _, ok := named[fields[0].name]; !ok {
+			return nil, false
+		}
+	}
+	return named, true
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func decodeArg(arg json.RawMessage, field reflect.Value) error {
+	switch {
+	case field.Type() == timeType:
+		t, err := decodeTime(arg)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+
+	case field.Kind() >= reflect.Int && field.Kind() <= reflect.Int64:
+		n, err := decodeInt(arg)
+		if err != nil {
+			return err
+		}
+		if field.OverflowInt(n) {
+			return fmt.Errorf("%d is out of range", n)
+		}
+		field.SetInt(n)
+		return nil
+	}
+
+	if err := json.Unmarshal(arg, field.Addr().Interface()); err != nil {
+		return fmt.Errorf("expected %s, got %s", field.Type(), arg)
+	}
+	return nil
+}
+
+// decodeInt accepts integers, integral floats such as 3.0 and numeric
+// strings, which is how ids are often written by hand.
+func decodeInt(arg json.RawMessage) (int64, error) {
+	text := string(bytes.Trim(bytes.TrimSpace(arg), `"`))
+
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f), nil
+	}
+	return 0, fmt.Errorf("expected an integer, got %s", arg)
+}
+
+// decodeTime accepts epoch seconds, as Sidekiq stores times, or an ISO 8601
+// string, as Rails serializes them.
+func decodeTime(arg json.RawMessage) (time.Time, error) {
+	var seconds float64
+	if err := json.Unmarshal(arg, &seconds); err == nil {
+		return time.Unix(0, int64(seconds*1e9)), nil
+	}
+
+	var text string
+	if err := json.Unmarshal(arg, &text); err == nil {
+		if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected a time, got %s", arg)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testArgs struct {
+	ID      int64     `arg:"id"`
+	Name    string    `arg:"name"`
+	At      time.Time `arg:"at,optional"`
+	Retries int8      `arg:"retries,optional"`
+}
+
+// argsJob builds a job whose arguments are the given JSON array.
+func argsJob(t *testing.T, args string) Job {
+	var job Job
+	if err := json.Unmarshal([]byte(`{"class":"TestWorker","args":`+args+`}`), &job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestDecodeArgs(t *testing.T) {
+	at := time.Date(2020, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		args string
+		want testArgs
+		err  bool
+	}{
+		{args: `[1, "a"]`, want: testArgs{ID: 1, Name: "a"}},
+		{args: `[{"id": 1, "name": "a"}]`, want: testArgs{ID: 1, Name: "a"}},
+		{args: `[9007199254740993, "a"]`, want: testArgs{ID: 9007199254740993, Name: "a"}},
+		{args: `["42", "a"]`, want: testArgs{ID: 42, Name: "a"}},
+		{args: `[3.0, "a"]`, want: testArgs{ID: 3, Name: "a"}},
+		{args: `[1, "a", 1602849600]`, want: testArgs{ID: 1, Name: "a", At: at}},
+		{args: `[1, "a", "2020-10-16T12:00:00Z"]`, want: testArgs{ID: 1, Name: "a", At: at}},
+		{args: `[1, "a", null, 3]`, want: testArgs{ID: 1, Name: "a", Retries: 3}},
+		{args: `[1]`, err: true},
+		{args: `[null, "a"]`, err: true},
+		{args: `[1.5, "a"]`, err: true},
+		{args: `["x", "a"]`, err: true},
+		{args: `[1, 2]`, err: true},
+		{args: `[1, "a", "yesterday"]`, err: true},
+		{args: `[1, "a", null, 300]`, err: true},
+		{args: `[1, "a", null, 3, "extra"]`, err: true},
+		{args: `[{"id": 1}]`, err: true},
+	}
+
+	for _, test := range tests {
+		var got testArgs
+		err := DecodeArgs(argsJob(t, test.args), &got)
+		if test.err {
+			if err == nil {
+				t.Errorf("DecodeArgs(%s) = %+v, want an error", test.args, got)
+			} else if _, ok := err.(*ArgumentError); !ok {
+				t.Errorf("DecodeArgs(%s) error is %T, want *ArgumentError", test.args, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("DecodeArgs(%s): %s", test.args, err)
+			continue
+		}
+		if !got.At.Equal(test.want.At) {
+			t.Errorf("DecodeArgs(%s) at = %s, want %s", test.args, got.At, test.want.At)
+		}
+		got.At, test.want.At = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("DecodeArgs(%s) = %+v, want %+v", test.args, got, test.want)
+		}
+	}
+}
+
+func TestDecodeArgsValidates(t *testing.T) {
+	var args MessageCreationArgs
+	if err := DecodeArgs(argsJob(t, `[0, "hi", 1]`), &args); err == nil {
+		t.Error("DecodeArgs accepted a chat_id of 0")
+	}
+	if err := DecodeArgs(argsJob(t, `[{"chat_id": 7, "text": "hi", "number": 2}]`), &args); err != nil {
+		t.Errorf("DecodeArgs: %s", err)
+	}
+	if args != (MessageCreationArgs{ChatID: 7, Text: "hi", Number: 2}) {
+		t.Errorf("DecodeArgs = %+v", args)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the Go app's configuration. It is built up in layers, each
+// overriding the one before: the defaults below, the optional YAML file and
+// then environment variables, which may come from a `.env` file.
+type Config struct {
+	// Environment picks the YAML section and the prefix of the Rails style
+	// variables, e.g. DEVELOPMENT_HOST. It comes from APP_ENV or RAILS_ENV.
+	Environment string `yaml:"-"`
+
+	// RedisURL is a redis:// URL or a bare host:port.
+	RedisURL string `yaml:"redis_url"`
+
+	// Host is the Rails app the workers call back into. It is required.
+	Host string `yaml:"host"`
+
+	Database DatabaseConfig `yaml:"database"`
+
+	Queues           string        `yaml:"queues"`
+	QueueLimits      string        `yaml:"queue_limits"`
+	QueueBackend     string        `yaml:"queue_backend"`
+	ReliableFetch    bool          `yaml:"reliable_fetch"`
+	Concurrency      int           `yaml:"concurrency"`
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout"`
+	UnknownJobsQueue string        `yaml:"unknown_jobs_queue"`
+	CronJobs         string        `yaml:"cron_jobs"`
+	JobTTLs          string        `yaml:"job_ttls"`
+}
+
+// defaultConfig matches config/sidekiq.yml and the development setup in
+// docker-compose.yml.
+func defaultConfig(environment string) *Config {
+	return &Config{
+		Environment: environment,
+		Database: DatabaseConfig{
+			DSN:             "instachat:instachat@tcp(instachat_database_development)/instachat_development",
+			MaxOpenConns:    10,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 3 * time.Minute,
+			TraceComments:   true,
+		},
+		QueueBackend:    "lists",
+		Concurrency:     5,
+		ShutdownTimeout: 8 * time.Second,
+	}
+}
+
+// LoadConfig loads and validates the configuration. The `.env` file is
+// read from ENV_FILE, or .env in the working directory when present, and
+// never overrides variables that are already set. The YAML file is read
+// from CONFIG_FILE, or config/app_config.yml when present.
+func LoadConfig() (*Config, error) {
+	envFile := os.Getenv("ENV_FILE")
+	if envFile == "" {
+		envFile = ".env"
+	}
+	if err := godotenv.Load(envFile); err != nil && !(os.IsNotExist(err) && os.Getenv("ENV_FILE") == "") {
+		return nil, fmt.Errorf("could not load %s: %s", envFile, err)
+	}
+
+	environment := firstEnv("APP_ENV", "RAILS_ENV")
+	if environment == "" {
+		environment = "development"
+	}
+	config := defaultConfig(environment)
+
+	configFile := os.Getenv("CONFIG_FILE")
+	if configFile == "" {
+		configFile = "config/app_config.yml"
+	}
+	if err := config.loadYAML(configFile); err != nil && !(os.IsNotExist(err) && os.Getenv("CONFIG_FILE") == "") {
+		return nil, fmt.Errorf("could not load %s: %s", configFile, err)
+	}
+
+	if err := config.loadEnv(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadYAML applies the `default` section of the file and then the section
+// of the environment, like config/app_config.yml. `${VAR}` references are
+// expanded from the environment, standing in for its ERB.
+func (config *Config) loadYAML(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var sections map[string]interface{}
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(content))), &sections); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"default", config.Environment} {
+		section, ok := sections[name]
+		if !ok || section == nil {
+			continue
+		}
+		raw, err := yaml.Marshal(section)
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(raw, config); err != nil {
+			return fmt.Errorf("section %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// loadEnv applies environment variables. The Redis URL, the Rails host and
+// the database also fall back to the variables the Rails app is configured
+// with in .env, prefixed with the environment.
+func (config *Config) loadEnv() error {
+	prefix := strings.ToUpper(config.Environment) + "_"
+
+	setString(&config.RedisURL, firstEnv("REDIS_URL", prefix+"REDIS_URL_GO_APP", prefix+"INSTACHAT_REDIS_URL"))
+	setString(&config.Host, firstEnv("APP_HOST", prefix+"HOST"))
+
+	if dsn := os.Getenv("DATABASE_DSN"); dsn != "" {
+		config.Database.DSN = dsn
+	} else if host := os.Getenv(prefix + "INSTACHAT_DATABASE_HOST_NAME"); host != "" {
+		mysqlConfig := mysql.NewConfig()
+		mysqlConfig.User = os.Getenv(prefix + "INSTACHAT_DATABASE_USER")
+		mysqlConfig.Passwd = os.Getenv(prefix + "INSTACHAT_DATABASE_PASSWORD")
+		mysqlConfig.Net = "tcp"
+		mysqlConfig.Addr = host
+		mysqlConfig.DBName = os.Getenv(prefix + "INSTACHAT_DATABASE_DATABASE_NAME")
+		config.Database.DSN = mysqlConfig.FormatDSN()
+	}
+
+	setString(&config.Queues, os.Getenv("QUEUES"))
+	setString(&config.QueueLimits, os.Getenv("QUEUE_LIMITS"))
+	setString(&config.QueueBackend, os.Getenv("QUEUE_BACKEND"))
+	setString(&config.UnknownJobsQueue, os.Getenv("UNKNOWN_JOBS_QUEUE"))
+	setString(&config.CronJobs, os.Getenv("CRON_JOBS"))
+	setString(&config.JobTTLs, os.Getenv("JOB_TTLS"))
+
+	var problems []string
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	check(setBool(&config.ReliableFetch, "RELIABLE_FETCH"))
+	check(setInt(&config.Concurrency, "CONCURRENCY"))
+	check(setDuration(&config.ShutdownTimeout, "SHUTDOWN_TIMEOUT"))
+	check(setInt(&config.Database.MaxOpenConns, "DATABASE_MAX_OPEN_CONNS"))
+	check(setInt(&config.Database.MaxIdleConns, "DATABASE_MAX_IDLE_CONNS"))
+	check(setDuration(&config.Database.ConnMaxLifetime, "DATABASE_CONN_MAX_LIFETIME"))
+	check(setBool(&config.Database.TraceComments, "DATABASE_TRACE_COMMENTS"))
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Validate checks every setting, so a mistake stops the app at boot
+// instead of surfacing with the first job that needs it.
+func (config *Config) Validate() error {
+	var problems []string
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if config.RedisURL == "" {
+		problems = append(problems, "redis_url is not set")
+	} else if strings.Contains(config.RedisURL, "://") {
+		if parsed, err := url.Parse(config.RedisURL); err != nil || (parsed.Scheme != "redis" && parsed.Scheme != "rediss") {
+			problems = append(problems, fmt.Sprintf("redis_url %q is not a redis:// URL", config.RedisURL))
+		}
+	}
+	// The message workers build their reindex URL from the host.
+	if config.Host == "" {
+		problems = append(problems, "host is not set")
+	} else if parsed, err := url.Parse(config.Host); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		problems = append(problems, fmt.Sprintf("host %q is not an http(s) URL", config.Host))
+	}
+
+	if _, err := mysql.ParseDSN(config.Database.DSN); err != nil {
+		problems = append(problems, fmt.Sprintf("database dsn: %s", err))
+	}
+	if config.Database.MaxOpenConns < 0 || config.Database.MaxIdleConns < 0 || config.Database.ConnMaxLifetime < 0 {
+		problems = append(problems, "database limits must not be negative")
+	}
+
+	if config.QueueBackend != "lists" && config.QueueBackend != "streams" {
+		problems = append(problems, fmt.Sprintf("queue_backend %q is neither lists nor streams", config.QueueBackend))
+	}
+	if config.Concurrency < 1 {
+		problems = append(problems, "concurrency must be at least 1")
+	}
+	if config.ShutdownTimeout < 0 {
+		problems = append(problems, "shutdown_timeout must not be negative")
+	}
+
+	queues, err := ParseQueues(config.QueueSpec())
+	check(err)
+	if err == nil {
+		check(queues.SetLimits(config.QueueLimits))
+	}
+	_, err = ParseJobTTLs(config.JobTTLs)
+	check(err)
+	_, err = ParsePeriodicJobs(config.CronJobs)
+	check(err)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// QueueSpec is the queues to consume, by default those of the registered
+// workers.
+func (config *Config) QueueSpec() string {
+	if config.Queues == "" {
+		return strings.Join(RegisteredQueues(), ",")
+	}
+	return config.Queues
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func setString(target *string, value string) {
+	if value != "" {
+		*target = value
+	}
+}
+
+func setBool(target *bool, name string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s %q is not a boolean", name, value)
+	}
+	*target = parsed
+	return nil
+}
+
+func setInt(target *int, name string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s %q is not an integer", name, value)
+	}
+	*target = parsed
+	return nil
+}
+
+// setDuration reads a duration such as "3m", or a number of seconds.
+func setDuration(target *time.Duration, name string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		*target = time.Duration(seconds) * time.Second
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s %q is not a duration", name, value)
+	}
+	*target = parsed
+	return nil
+}
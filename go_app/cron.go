@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"instchat_endpoints/sidekiq"
+)
+
+// CronSpec is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week. Each field is a set of allowed values.
+type CronSpec struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseCron reads expressions like "0 * * * *", "*/15 9-17 * * mon-fri"
+// or "@hourly".
+func ParseCron(expression string) (*CronSpec, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(expression)]; ok {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expression)
+	}
+
+	var spec CronSpec
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if spec.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	if spec.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 mean Sunday.
+	if spec.dow[7] {
+		spec.dow[0] = true
+	}
+	spec.domAny = fields[2] == "*"
+	spec.dowAny = fields[4] == "*"
+	return &spec, nil
+}
+
+// parseCronField reads a comma separated list of `*`, `n`, `a-b`, each
+// optionally followed by `/step`. names, if given, are accepted for the
+// values starting at min.
+func parseCronField(field string, min, max int, names []string) (map[int]bool, error) {
+	values := make(map[int]bool)
+
+	value := func(text string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(text, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid cron value %q", text)
+		}
+		return n, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return nil, fmt.Errorf("invalid cron step %q", part)
+			}
+			rangePart, step = part[:i], s
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = value(bounds[0]); err != nil {
+				return nil, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = value(bounds[1]); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				high = max
+			}
+			if high < low {
+				return nil, fmt.Errorf("invalid cron range %q", part)
+			}
+		}
+
+		for n := low; n <= high; n += step {
+			values[n] = true
+		}
+	}
+	return values, nil
+}
+
+// Matches reports whether the spec fires in the minute of t.
+func (spec *CronSpec) Matches(t time.Time) bool {
+	return spec.minute[t.Minute()] && spec.hour[t.Hour()] && spec.month[int(t.Month())] && spec.dayMatches(t)
+}
+
+// dayMatches checks the two day fields. As in cron, when both are
+// restricted either one matching is enough.
+func (spec *CronSpec) dayMatches(t time.Time) bool {
+	dom, dow := spec.dom[t.Day()], spec.dow[int(t.Weekday())]
+	switch {
+	case spec.domAny && spec.dowAny:
+		return true
+	case spec.domAny:
+		return dow
+	case spec.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// Next returns the first minute after t the spec fires in, skipping whole
+// months, days and hours that cannot match.
+func (spec *CronSpec) Next(t time.Time) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	// Five years covers every valid expression, including Feb 29th.
+	limit := next.AddDate(5, 0, 0)
+
+	for next.Before(limit) {
+		year, month, day := next.Date()
+		switch {
+		case !spec.month[int(month)]:
+			next = time.Date(year, month+1, 1, 0, 0, 0, 0, next.Location())
+		case !spec.dayMatches(next):
+			next = time.Date(year, month, day+1, 0, 0, 0, 0, next.Location())
+		case !spec.hour[next.Hour()]:
+			next = time.Date(year, month, day, next.Hour()+1, 0, 0, 0, next.Location())
+		case !spec.minute[next.Minute()]:
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// PeriodicJob is a job fired on a cron schedule. It either enqueues Class
+// on Queue with Args through the Sidekiq client, for a worker in Go or in
+// Ruby to pick up, or calls Run directly in this process.
+type PeriodicJob struct {
+	Name  string
+	Spec  *CronSpec
+	Class string
+	Queue string
+	Args  []interface{}
+	Run   func() error
+}
+
+// CronScheduler fires periodic jobs. Every instance checks the schedule
+// each minute, but a Redis lock per job and minute lets only one of them
+// fire a tick. The last and next run of every job are kept in the
+// `cron:<name>` hash.
+type CronScheduler struct {
+	pool   *redis.Pool
+	client *sidekiq.Client
+	jobs   []PeriodicJob
+}
+
+func NewCronScheduler(pool *redis.Pool) *CronScheduler {
+	return &CronScheduler{pool: pool, client: sidekiq.NewClient(pool, namespace)}
+}
+
+func (scheduler *CronScheduler) Register(job PeriodicJob) {
+	scheduler.jobs = append(scheduler.jobs, job)
+}
+
+// Run fires the registered jobs until done is closed.
+func (scheduler *CronScheduler) Run(done chan struct{}) {
+	if len(scheduler.jobs) == 0 {
+		return
+	}
+
+	scheduler.recordNextRuns(time.Now())
+	for {
+		now := time.Now()
+		tick := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute()+1, 0, 0, now.Location())
+
+		select {
+		case <-time.After(time.Until(tick)):
+		case <-done:
+			return
+		}
+
+		for _, job := range scheduler.jobs {
+			if job.Spec.Matches(tick) {
+				scheduler.fire(job, tick)
+			}
+		}
+	}
+}
+
+func (scheduler *CronScheduler) fire(job PeriodicJob, tick time.Time) {
+	conn := scheduler.pool.Get()
+	defer conn.Close()
+
+	lock := namespaced(fmt.Sprintf("cron:%s:%d", job.Name, tick.Unix()))
+	if _, err := redis.String(conn.Do("SET", lock, identity, "NX", "EX", 300)); err != nil {
+		// Another instance holds this tick, or Redis is unavailable.
+		return
+	}
+
+	var err error
+	if job.Run != nil {
+		err = job.Run()
+	} else {
+		_, err = scheduler.client.Push(sidekiq.Job{Class: job.Class, Queue: job.Queue, Args: job.Args})
+	}
+	if err != nil {
+		fmt.Printf("Periodic job %s failed: %s\n", job.Name, err)
+	}
+
+	_, err = conn.Do("HSET", namespaced("cron:"+job.Name),
+		"last_run", epoch(tick),
+		"next_run", epoch(job.Spec.Next(tick)))
+	if err != nil {
+		fmt.Printf("Could not record run of periodic job %s: %s\n", job.Name, err)
+	}
+}
+
+func (scheduler *CronScheduler) recordNextRuns(now time.Time) {
+	conn := scheduler.pool.Get()
+	defer conn.Close()
+
+	for _, job := range scheduler.jobs {
+		if _, err := conn.Do("HSET", namespaced("cron:"+job.Name), "next_run", epoch(job.Spec.Next(now))); err != nil {
+			fmt.Printf("Could not record next run of periodic job %s: %s\n", job.Name, err)
+		}
+	}
+}
+
+// ParsePeriodicJobs reads periodic jobs that enqueue a class, one per line
+// or separated by `;`, as `name|cron expression|Class[|queue]`, e.g.
+// "sync_chats|0 * * * *|SyncChatsWorker|default". Without a queue, jobs go
+// to the queue their class is registered with.
+func ParsePeriodicJobs(spec string) ([]PeriodicJob, error) {
+	var jobs []PeriodicJob
+
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, "|")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid periodic job %q", entry)
+		}
+		cron, err := ParseCron(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		job := PeriodicJob{Name: strings.TrimSpace(parts[0]), Spec: cron, Class: strings.TrimSpace(parts[2])}
+		if len(parts) == 4 {
+			job.Queue = strings.TrimSpace(parts[3])
+		} else {
+			job.Queue = defaultQueue(job.Class)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"1-2-3 * * * *",
+		"* * * foo *",
+		"@never",
+	} {
+		if _, err := ParseCron(expression); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want an error", expression)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expression string
+		from       time.Time
+		want       time.Time
+	}{
+		{"* * * * *", at(2020, 10, 16, 10, 30).Add(45 * time.Second), at(2020, 10, 16, 10, 31)},
+		{"0 * * * *", at(2020, 10, 16, 10, 30), at(2020, 10, 16, 11, 0)},
+		{"0 * * * *", at(2020, 10, 16, 11, 0), at(2020, 10, 16, 12, 0)},
+		{"@hourly", at(2020, 12, 31, 23, 59), at(2021, 1, 1, 0, 0)},
+		{"@yearly", at(2020, 6, 1, 0, 0), at(2021, 1, 1, 0, 0)},
+		{"@weekly", at(2020, 10, 16, 10, 0), at(2020, 10, 18, 0, 0)},
+		{"*/15 9-17 * * mon-fri", at(2020, 10, 16, 17, 50), at(2020, 10, 19, 9, 0)},
+		{"*/15 9-17 * * mon-fri", at(2020, 10, 19, 9, 1), at(2020, 10, 19, 9, 15)},
+		{"10/20 * * * *", at(2020, 10, 16, 10, 31), at(2020, 10, 16, 10, 50)},
+		{"0 0 1,15 * *", at(2020, 10, 2, 0, 0), at(2020, 10, 15, 0, 0)},
+		{"5 4 * * 7", at(2020, 10, 16, 0, 0), at(2020, 10, 18, 4, 5)},
+		{"5 4 * * sun", at(2020, 10, 16, 0, 0), at(2020, 10, 18, 4, 5)},
+		{"0 12 * JAN-mar *", at(2020, 10, 16, 0, 0), at(2021, 1, 1, 12, 0)},
+		{"30 12 31 * *", at(2020, 4, 1, 0, 0), at(2020, 5, 31, 12, 30)},
+		{"0 0 29 2 *", at(2021, 3, 1, 0, 0), at(2024, 2, 29, 0, 0)},
+		// Day of month and day of week both restricted: either one fires.
+		{"0 0 13 * fri", at(2020, 10, 1, 0, 0), at(2020, 10, 2, 0, 0)},
+		{"0 0 13 * fri", at(2020, 10, 9, 0, 0), at(2020, 10, 13, 0, 0)},
+		{"0 0 30 2 *", at(2020, 1, 1, 0, 0), time.Time{}},
+	}
+
+	for _, test := range tests {
+		spec, err := ParseCron(test.expression)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %s", test.expression, err)
+			continue
+		}
+		if got := spec.Next(test.from); !got.Equal(test.want) {
+			t.Errorf("%q.Next(%s) = %s, want %s", test.expression, test.from, got, test.want)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	spec, err := ParseCron("0 9 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2020, 10, 19, 9, 0, 30, 0, time.UTC), true},
+		{time.Date(2020, 10, 19, 9, 1, 0, 0, time.UTC), false},
+		{time.Date(2020, 10, 17, 9, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		if got := spec.Matches(test.at); got != test.want {
+			t.Errorf("Matches(%s) = %v, want %v", test.at, got, test.want)
+		}
+	}
+}
+
+func TestParsePeriodicJobs(t *testing.T) {
+	jobs, err := ParsePeriodicJobs("sync|0 * * * *|SyncWorker|low;\n cleanup | @daily | CleanupWorker ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Name != "sync" || jobs[0].Queue != "low" ||
+		jobs[1].Name != "cleanup" || jobs[1].Class != "CleanupWorker" || jobs[1].Queue != "default" {
+		t.Errorf("ParsePeriodicJobs = %+v", jobs)
+	}
+
+	for _, spec := range []string{"sync|0 * * * *", "sync|61 * * * *|SyncWorker", "a|b|c|d|e"} {
+		if _, err := ParsePeriodicJobs(spec); err == nil {
+			t.Errorf("ParsePeriodicJobs(%q) succeeded, want an error", spec)
+		}
+	}
+}
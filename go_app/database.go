@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// How often the pool is pinged, and how long a ping may take.
+const (
+	pingInterval = 30 * time.Second
+	pingTimeout  = 5 * time.Second
+)
+
+// DatabaseConfig sets up the MySQL pool.
+type DatabaseConfig struct {
+	DSN             string        `yaml:"dsn"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+
+	// TraceComments appends each job's sqlcommenter comment to its
+	// statements. A prepared statement's text is fixed, so traced
+	// statements are sent with their arguments interpolated instead of
+	// through the statement cache.
+	TraceComments bool `yaml:"trace_comments"`
+}
+
+// Database is the MySQL pool shared by all workers for the life of the
+// process. Statements are prepared once per query and reused by every job;
+// database/sql re-prepares them on whichever connection runs them. With
+// trace comments on, statements carry the job's comment and skip the cache.
+type Database struct {
+	*sql.DB
+	traceComments bool
+
+	mu         sync.Mutex
+	statements map[string]*sql.Stmt
+}
+
+// OpenDatabase creates the pool and pings it once. An unreachable database
+// is only reported, as the pool connects again on first use.
+func OpenDatabase(config DatabaseConfig) (*Database, error) {
+	mysqlConfig, err := mysql.ParseDSN(config.DSN)
+	if err != nil {
+		return nil, err
+	}
+	// Traced statements are sent in one round trip, without a prepare.
+	mysqlConfig.InterpolateParams = config.TraceComments
+
+	db, err := sql.Open("mysql", mysqlConfig.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+
+	database := &Database{DB: db, traceComments: config.TraceComments, statements: make(map[string]*sql.Stmt)}
+	if err := database.ping(); err != nil {
+		fmt.Printf("Database is not reachable yet: %s\n", err)
+	}
+	return database, nil
+}
+
+// Statement returns the prepared statement for query, preparing it the
+// first time it is asked for.
+func (database *Database) Statement(ctx context.Context, query string) (*sql.Stmt, error) {
+	database.mu.Lock()
+	defer database.mu.Unlock()
+
+	if statement, ok := database.statements[query]; ok {
+		return statement, nil
+	}
+
+	statement, err := database.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	database.statements[query] = statement
+	return statement, nil
+}
+
+// Exec runs query for job: with the job's trace comment when trace
+// comments are on, and otherwise through its cached prepared statement.
+func (database *Database) Exec(ctx context.Context, job *Job, query string, args ...interface{}) (sql.Result, error) {
+	if database.traceComments {
+		return database.ExecContext(ctx, query+job.SQLComment(), args...)
+	}
+
+	statement, err := database.Statement(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return statement.ExecContext(ctx, args...)
+}
+
+// MonitorHealth pings the database until done is closed, logging when it
+// becomes unreachable and when it is back.
+func (database *Database) MonitorHealth(done chan struct{}) {
+	healthy := true
+	for {
+		select {
+		case <-time.After(pingInterval):
+		case <-done:
+			return
+		}
+
+		err := database.ping()
+		if err != nil && healthy {
+			fmt.Printf("Database is not reachable: %s\n", err)
+		} else if err == nil && !healthy {
+			fmt.Println("Database is reachable again")
+		}
+		healthy = err == nil
+	}
+}
+
+func (database *Database) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return database.PingContext(ctx)
+}
+
+// Close closes the cached statements and then the pool.
+func (database *Database) Close() error {
+	database.mu.Lock()
+	defer database.mu.Unlock()
+
+	for query, statement := range database.statements {
+		statement.Close()
+		delete(database.statements, query)
+	}
+	return database.DB.Close()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Same limits as Sidekiq's dead_max_jobs and dead_timeout_in_seconds.
+const (
+	deadMaxJobs = 10000
+	deadTimeout = 180 * 24 * time.Hour
+)
+
+// KillJob moves a job into the Sidekiq morgue.
+func KillJob(conn redis.Conn, job Job) error {
+	payload, err := dumpJSON(job)
+	if err != nil {
+		return err
+	}
+
+	if err := KillPayload(conn, payload); err != nil {
+		return err
+	}
+
+	job.Logf("adding dead job")
+	return nil
+}
+
+// KillPayload adds a raw payload to the morgue and trims the set by age
+// and size in the same transaction, exactly like Sidekiq::DeadSet#kill.
+// Sidekiq does the same with jobs it cannot even parse.
+func KillPayload(conn redis.Conn, payload []byte) error {
+	conn.Send("MULTI")
+	sendKillPayload(conn, payload, time.Now())
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// sendKillPayload only sends the commands of KillPayload, for callers that
+// kill a payload as part of a transaction of their own.
+func sendKillPayload(conn redis.Conn, payload []byte, now time.Time) {
+	dead := namespaced("dead")
+
+	conn.Send("ZADD", dead, epoch(now), payload)
+	conn.Send("ZREMRANGEBYSCORE", dead, "-inf", epoch(now.Add(-deadTimeout)))
+	conn.Send("ZREMRANGEBYRANK", dead, 0, -deadMaxJobs)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// A job is deferred at most this many times before it fails like any other.
+const maxDeferrals = 10
+
+// DeferError is returned by a worker whose job cannot run yet, like a
+// message whose chat row has not been inserted. The job is put back in the
+// schedule set instead of being counted as a failure.
+type DeferError struct {
+	Reason string
+	Delay  time.Duration
+}
+
+func (err *DeferError) Error() string {
+	return fmt.Sprintf("deferred for %s: %s", err.Delay, err.Reason)
+}
+
+// DeferJob schedules the job to run again after the delay, keeping count
+// of its deferrals in the payload. It falls back to RetryJob once the job
+// was deferred too often.
+func DeferJob(conn redis.Conn, job Job, deferral *DeferError) error {
+	var deferrals int
+	if _, err := job.Get("deferred_count", &deferrals); err != nil {
+		return err
+	}
+	if deferrals >= maxDeferrals {
+		return RetryJob(conn, job, deferral)
+	}
+	if err := job.Set("deferred_count", deferrals+1); err != nil {
+		return err
+	}
+
+	payload, err := dumpJSON(job)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Do("ZADD", namespaced("schedule"), epoch(time.Now().Add(deferral.Delay)), payload); err != nil {
+		return err
+	}
+
+	job.Logf("deferred: %s", deferral.Reason)
+	return nil
+}
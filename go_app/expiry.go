@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ExpiredError is returned for a job that waited in its queue longer than
+// its time to live.
+type ExpiredError struct {
+	Age time.Duration
+	TTL time.Duration
+}
+
+func (err *ExpiredError) Error() string {
+	return fmt.Sprintf("expired: enqueued %s ago, time to live is %s", err.Age.Round(time.Second), err.TTL)
+}
+
+// ttl is the job's own `expires_in` in seconds, like Sidekiq Enterprise's
+// option, or else the TTL of its class, looked up by the wrapped class for
+// ActiveJob jobs. Zero means the job never expires.
+func (job *Job) ttl(classTTLs map[string]time.Duration) time.Duration {
+	var seconds float64
+	if ok, err := job.Get("expires_in", &seconds); ok && err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return classTTLs[job.workerClass()]
+}
+
+// ExpiryMiddleware skips jobs that were enqueued longer ago than their time
+// to live. Classes without a TTL, like the chat and message creation
+// workers, never expire unless a job sets `expires_in` itself.
+func ExpiryMiddleware(classTTLs map[string]time.Duration) Middleware {
+	return func(worker Worker, job *Job, next func() error) error {
+		ttl := job.ttl(classTTLs)
+		if ttl <= 0 || job.EnqueuedAt == 0 {
+			return next()
+		}
+
+		enqueuedAt := time.Unix(0, int64(job.EnqueuedAt*1e9))
+		if age := time.Since(enqueuedAt); age > ttl {
+			return &ExpiredError{Age: age, TTL: ttl}
+		}
+		return next()
+	}
+}
+
+// ExpireJob puts an expired job in the dead set with the reason recorded,
+// or drops it if it was enqueued with `dead: false`.
+func ExpireJob(conn redis.Conn, job Job, expired *ExpiredError) error {
+	job.ErrorMessage = expired.Error()
+	job.ErrorClass = errorClass(expired)
+	job.FailedAt = epoch(time.Now())
+	return retriesExhausted(conn, job)
+}
+
+// ParseJobTTLs reads a comma separated list of `Class:duration` entries,
+// e.g. "ReindexWorker:1h,NotificationWorker:15m".
+func ParseJobTTLs(spec string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("missing time to live in %q", entry)
+		}
+		ttl, err := time.ParseDuration(entry[i+1:])
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid time to live in %q", entry)
+		}
+		ttls[entry[:i]] = ttl
+	}
+	return ttls, nil
+}
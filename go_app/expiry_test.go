@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestJobTTL(t *testing.T) {
+	classTTLs := map[string]time.Duration{"ReindexWorker": time.Hour, "ReindexJob": 15 * time.Minute}
+
+	tests := []struct {
+		name    string
+		payload string
+		ttl     time.Duration
+	}{
+		{"class ttl", `{"class":"ReindexWorker","args":[]}`, time.Hour},
+		{"no ttl", `{"class":"MessageCreationWorker","args":[]}`, 0},
+		{"expires_in", `{"class":"MessageCreationWorker","args":[],"expires_in":30}`, 30 * time.Second},
+		{"expires_in over class ttl", `{"class":"ReindexWorker","args":[],"expires_in":60}`, time.Minute},
+		{
+			name:    "wrapped activejob",
+			payload: `{"class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","wrapped":"ReindexJob","args":[{"job_class":"ReindexJob","arguments":[]}]}`,
+			ttl:     15 * time.Minute,
+		},
+		{
+			name:    "activejob without wrapped",
+			payload: `{"class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","args":[{"job_class":"ReindexJob","arguments":[]}]}`,
+			ttl:     15 * time.Minute,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var job Job
+			if err := json.Unmarshal([]byte(test.payload), &job); err != nil {
+				t.Fatal(err)
+			}
+			if ttl := job.ttl(classTTLs); ttl != test.ttl {
+				t.Errorf("ttl = %s, want %s", ttl, test.ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// PanicError is a panic raised while building or performing a job, caught
+// so it fails that job alone instead of the whole consumer.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.Value)
+}
+
+// MalformedJobError is returned by a Fetcher for a payload that is not a
+// valid job.
+type MalformedJobError struct {
+	Payload []byte
+	Err     error
+}
+
+func (err *MalformedJobError) Error() string {
+	return fmt.Sprintf("malformed job payload: %s", err.Err)
+}
+
+// UnknownJobError is returned for a job whose class has no Go worker.
+type UnknownJobError struct {
+	Class string
+}
+
+func (err *UnknownJobError) Error() string {
+	return fmt.Sprintf("no worker registered for %s", err.Class)
+}
+
+// TimeoutError is a job that failed because it ran past its class's
+// timeout. It is retried like any other failure, so whatever the job
+// committed before timing out must be safe to run again.
+type TimeoutError struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s: %s", err.Timeout, err.Err)
+}
+
+func (err *TimeoutError) Unwrap() error {
+	return err.Err
+}
+
+// RouteUnknownJob hands a job nobody here can perform to the fallback
+// queue, typically one consumed by Ruby Sidekiq, or to the dead set with
+// the error recorded when no fallback queue is configured. Retrying it
+// would not help until a worker is registered.
+func RouteUnknownJob(conn redis.Conn, job Job, failure error, fallbackQueue string) error {
+	if fallbackQueue != "" {
+		job.Queue = fallbackQueue
+		payload, err := dumpJSON(job)
+		if err != nil {
+			return err
+		}
+
+		conn.Send("MULTI")
+		pushList(conn, fallbackQueue, payload)
+		if _, err := conn.Do("EXEC"); err != nil {
+			return err
+		}
+
+		job.Logf("moved to the %s queue", fallbackQueue)
+		return nil
+	}
+
+	job.ErrorMessage = failure.Error()
+	job.ErrorClass = errorClass(failure)
+	job.FailedAt = epoch(time.Now())
+	return KillJob(conn, job)
+}
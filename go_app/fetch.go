@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// A Fetcher pulls the next job off a queue and is told once that job has
+// been fully handled, either performed or handed over to the retry/dead sets.
+// Fetch returns redis.ErrNil when no job arrived within fetchTimeout, and
+// Requeue gives back a job that was fetched but not finished at shutdown.
+// Push only sends the commands adding a payload to a queue, so callers can
+// make it part of a MULTI transaction. Size counts the jobs of a queue that
+// are still waiting to be fetched.
+type Fetcher interface {
+	Fetch(conn redis.Conn) (Job, error)
+	Acknowledge(conn redis.Conn, job Job) error
+	Requeue(conn redis.Conn, job Job) error
+	Push(conn redis.Conn, queue string, payload []byte)
+	Size(conn redis.Conn, queue string) (int64, error)
+}
+
+// A releasingFetcher holds on to jobs it fetched ahead of Fetch returning
+// them, and gives them back when the listener stops.
+type releasingFetcher interface {
+	Release(conn redis.Conn) error
+}
+
+func queueKey(name string) string {
+	return namespaced("queue:" + name)
+}
+
+func listSize(conn redis.Conn, queue string) (int64, error) {
+	return redis.Int64(conn.Do("LLEN", queueKey(queue)))
+}
+
+// pushList is how Sidekiq::Client enqueues: register the queue in the
+// `queues` set and LPUSH the payload.
+func pushList(conn redis.Conn, queue string, payload []byte) {
+	conn.Send("SADD", namespaced("queues"), queue)
+	conn.Send("LPUSH", queueKey(queue), payload)
+}
+
+func parseJob(payload []byte) (Job, error) {
+	var job Job
+	err := json.Unmarshal(payload, &job)
+	job.payload = payload
+	if err != nil {
+		return job, &MalformedJobError{Payload: payload, Err: err}
+	}
+	return job, nil
+}
+
+// identity names this process the way Sidekiq does: hostname:pid:nonce.
+var identity = newIdentity()
+
+func newIdentity() string {
+	hostname, _ := os.Hostname()
+	nonce := make([]byte, 6)
+	rand.Read(nonce)
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), hex.EncodeToString(nonce))
+}
+
+// Blocking fetches time out after this long so weighted queues get
+// reshuffled and shutdown is noticed, like Sidekiq's BasicFetch::TIMEOUT.
+const fetchTimeout = 2
+
+// basicFetch pops jobs with BRPOP, oldest first since producers LPUSH like
+// Sidekiq does; a job is lost if the process dies before it is performed.
+type basicFetch struct {
+	queues *Queues
+}
+
+func NewBasicFetch(queues *Queues) Fetcher {
+	return &basicFetch{queues: queues}
+}
+
+func (fetch *basicFetch) Fetch(conn redis.Conn) (Job, error) {
+	args := redis.Args{}.AddFlat(fetch.queues.Ordered(queueKey)).Add(fetchTimeout)
+	reply, err := redis.Values(conn.Do("BRPOP", args...))
+	if err != nil {
+		return Job{}, err
+	}
+
+	var queue string
+	var body []byte
+	if _, err := redis.Scan(reply, &queue, &body); err != nil {
+		return Job{}, err
+	}
+	return parseJob(body)
+}
+
+func (fetch *basicFetch) Acknowledge(conn redis.Conn, job Job) error {
+	return nil
+}
+
+func (fetch *basicFetch) Push(conn redis.Conn, queue string, payload []byte) {
+	pushList(conn, queue, payload)
+}
+
+func (fetch *basicFetch) Size(conn redis.Conn, queue string) (int64, error) {
+	return listSize(conn, queue)
+}
+
+// Requeue puts the job back at the tail of its queue, where BRPOP takes
+// the next job from.
+func (fetch *basicFetch) Requeue(conn redis.Conn, job Job) error {
+	_, err := conn.Do("RPUSH", queueKey(job.Queue), job.payload)
+	return err
+}
+
+// How often a reliable fetcher proves it is still alive, and how long its
+// working list is protected from recovery after the last proof.
+const (
+	workingHeartbeatInterval = 20 * time.Second
+	workingHeartbeatTTL      = 60 * time.Second
+)
+
+// recoverWorkingScript pushes every job of an orphaned working list back
+// onto the queue named in its payload, oldest job first in line.
+var recoverWorkingScript = redis.NewScript(1, `
+local working, prefix = KEYS[1], ARGV[1]
+local count = 0
+local job = redis.call('lpop', working)
+while job do
+  local ok, msg = pcall(cjson.decode, job)
+  local queue = 'default'
+  if ok and type(msg) == 'table' and type(msg['queue']) == 'string' then
+    queue = msg['queue']
+  end
+  redis.call('sadd', prefix .. 'queues', queue)
+  redis.call('rpush', prefix .. 'queue:' .. queue, job)
+  count = count + 1
+  job = redis.call('lpop', working)
+end
+return count
+`)
+
+// reliableFetch moves each job with BRPOPLPUSH into a working list owned
+// by this process and only removes it from there once it is acknowledged,
+// so jobs in flight survive a crash and are recovered by the next process.
+type reliableFetch struct {
+	queues  *Queues
+	working string
+}
+
+// NewReliableFetch recovers orphaned jobs and keeps the working list's
+// heartbeat alive until done is closed.
+func NewReliableFetch(pool *redis.Pool, queues *Queues, done chan struct{}) (Fetcher, error) {
+	fetch := &reliableFetch{
+		queues:  queues,
+		working: workingList(identity),
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if err := recoverOrphanedJobs(conn); err != nil {
+		return nil, err
+	}
+	if err := beatWorkingList(conn); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Do("SADD", namespaced("working"), identity); err != nil {
+		return nil, err
+	}
+
+	// Orphans are looked for on every beat too: a process that crashed and
+	// restarted within seconds finds its old heartbeat still alive at boot.
+	go func() {
+		ticker := time.NewTicker(workingHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			conn := pool.Get()
+			if err := beatWorkingList(conn); err != nil {
+				fmt.Printf("Working list heartbeat failed: %s\n", err)
+			}
+			if err := recoverOrphanedJobs(conn); err != nil {
+				fmt.Printf("Could not recover orphaned jobs: %s\n", err)
+			}
+			conn.Close()
+		}
+	}()
+
+	return fetch, nil
+}
+
+// Fetch checks every queue in turn without blocking, since BRPOPLPUSH can
+// only watch a single source, and then blocks briefly on the first queue.
+func (fetch *reliableFetch) Fetch(conn redis.Conn) (Job, error) {
+	queues := fetch.queues.Ordered(queueKey)
+
+	for _, queue := range queues {
+		body, err := redis.Bytes(conn.Do("RPOPLPUSH", queue, fetch.working))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return Job{}, err
+		}
+		return parseJob(body)
+	}
+
+	body, err := redis.Bytes(conn.Do("BRPOPLPUSH", queues[0], fetch.working, fetchTimeout))
+	if err != nil {
+		return Job{}, err
+	}
+	return parseJob(body)
+}
+
+func (fetch *reliableFetch) Acknowledge(conn redis.Conn, job Job) error {
+	_, err := conn.Do("LREM", fetch.working, -1, job.payload)
+	return err
+}
+
+func (fetch *reliableFetch) Push(conn redis.Conn, queue string, payload []byte) {
+	pushList(conn, queue, payload)
+}
+
+func (fetch *reliableFetch) Size(conn redis.Conn, queue string) (int64, error) {
+	return listSize(conn, queue)
+}
+
+// Requeue moves the job from the working list back to the tail of its
+// queue, where RPOPLPUSH takes the next job from.
+func (fetch *reliableFetch) Requeue(conn redis.Conn, job Job) error {
+	conn.Send("MULTI")
+	conn.Send("RPUSH", queueKey(job.Queue), job.payload)
+	conn.Send("LREM", fetch.working, -1, job.payload)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func workingList(owner string) string {
+	return namespaced("working:" + owner)
+}
+
+func beatWorkingList(conn redis.Conn) error {
+	_, err := conn.Do("SET", workingList(identity)+":heartbeat", 1, "EX", int(workingHeartbeatTTL.Seconds()))
+	return err
+}
+
+// recoverOrphanedJobs requeues the working lists of processes that stopped
+// sending heartbeats.
+func recoverOrphanedJobs(conn redis.Conn) error {
+	owners, err := redis.Strings(conn.Do("SMEMBERS", namespaced("working")))
+	if err != nil {
+		return err
+	}
+
+	for _, owner := range owners {
+		alive, err := redis.Bool(conn.Do("EXISTS", workingList(owner)+":heartbeat"))
+		if err != nil {
+			return err
+		}
+		if alive {
+			continue
+		}
+
+		count, err := redis.Int(recoverWorkingScript.Do(conn, workingList(owner), namespace+":"))
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Do("SREM", namespaced("working"), owner); err != nil {
+			return err
+		}
+		if count > 0 {
+			fmt.Printf("Recovered %d jobs from dead process %s\n", count, owner)
+		}
+	}
+	return nil
+}
@@ -6,4 +6,5 @@ require (
 	github.com/garyburd/redigo v1.6.2
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/joho/godotenv v1.3.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Sidekiq beats every 5 seconds and lets a process entry expire a minute
+// after its last beat.
+const (
+	beatInterval = 5 * time.Second
+	beatTTL      = 60
+)
+
+// processInfo is the `info` field Sidekiq::Web reads for every process.
+type processInfo struct {
+	Hostname    string   `json:"hostname"`
+	StartedAt   float64  `json:"started_at"`
+	Pid         int      `json:"pid"`
+	Tag         string   `json:"tag"`
+	Concurrency int      `json:"concurrency"`
+	Queues      []string `json:"queues"`
+	Labels      []string `json:"labels"`
+	Identity    string   `json:"identity"`
+
+	// Workers describes the registered worker classes.
+	Workers map[string]workerInfo `json:"workers"`
+}
+
+// work is one entry of the `<identity>:workers` hash behind the Busy tab.
+type work struct {
+	Queue   string          `json:"queue"`
+	Payload json.RawMessage `json:"payload"`
+	RunAt   int64           `json:"run_at"`
+}
+
+// Heartbeat registers this process in Sidekiq's `processes` set and keeps
+// its info and in-progress jobs fresh, so the Go workers show up on the
+// Sidekiq::Web Busy tab next to Ruby ones.
+type Heartbeat struct {
+	pool *redis.Pool
+	info []byte
+
+	mu      sync.Mutex
+	busy    map[string]work
+	lastTid int64
+	quiet   bool
+	stop    chan struct{}
+}
+
+func NewHeartbeat(pool *redis.Pool, queues *Queues, concurrency int) *Heartbeat {
+	hostname, _ := os.Hostname()
+	info, _ := json.Marshal(processInfo{
+		Hostname:    hostname,
+		StartedAt:   epoch(time.Now()),
+		Pid:         os.Getpid(),
+		Concurrency: concurrency,
+		Queues:      queues.Names(),
+		Labels:      []string{"go"},
+		Identity:    identity,
+		Workers:     registryInfo(),
+	})
+
+	return &Heartbeat{
+		pool: pool,
+		info: info,
+		busy: make(map[string]work),
+		stop: make(chan struct{}),
+	}
+}
+
+// Started records a job as in progress and returns the id it is tracked
+// under, to be handed back to Finished.
+func (heartbeat *Heartbeat) Started(job Job) string {
+	payload := json.RawMessage(job.payload)
+	if payload == nil {
+		payload, _ = dumpJSON(job)
+	}
+
+	heartbeat.mu.Lock()
+	defer heartbeat.mu.Unlock()
+
+	heartbeat.lastTid++
+	tid := strconv.FormatInt(heartbeat.lastTid, 36)
+	heartbeat.busy[tid] = work{Queue: job.Queue, Payload: payload, RunAt: time.Now().Unix()}
+	return tid
+}
+
+func (heartbeat *Heartbeat) Finished(tid string) {
+	heartbeat.mu.Lock()
+	defer heartbeat.mu.Unlock()
+
+	delete(heartbeat.busy, tid)
+}
+
+// Quiet marks the process as stopping in Sidekiq::Web; it no longer
+// fetches but is still finishing its busy jobs.
+func (heartbeat *Heartbeat) Quiet() {
+	heartbeat.mu.Lock()
+	heartbeat.quiet = true
+	heartbeat.mu.Unlock()
+
+	if err := heartbeat.beat(); err != nil {
+		fmt.Printf("Heartbeat failed: %s\n", err)
+	}
+}
+
+func (heartbeat *Heartbeat) Run() {
+	ticker := time.NewTicker(beatInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := heartbeat.beat(); err != nil {
+			fmt.Printf("Heartbeat failed: %s\n", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-heartbeat.stop:
+			return
+		}
+	}
+}
+
+func (heartbeat *Heartbeat) beat() error {
+	heartbeat.mu.Lock()
+	busy := make(map[string][]byte, len(heartbeat.busy))
+	for tid, w := range heartbeat.busy {
+		busy[tid], _ = json.Marshal(w)
+	}
+	quiet := heartbeat.quiet
+	heartbeat.mu.Unlock()
+
+	conn := heartbeat.pool.Get()
+	defer conn.Close()
+
+	workers := identity + ":workers"
+
+	conn.Send("MULTI")
+	conn.Send("SADD", namespaced("processes"), identity)
+	conn.Send("HMSET", namespaced(identity),
+		"info", heartbeat.info,
+		"busy", len(busy),
+		"beat", epoch(time.Now()),
+		"quiet", strconv.FormatBool(quiet))
+	conn.Send("EXPIRE", namespaced(identity), beatTTL)
+	conn.Send("DEL", namespaced(workers))
+	for tid, w := range busy {
+		conn.Send("HSET", namespaced(workers), tid, w)
+	}
+	conn.Send("EXPIRE", namespaced(workers), beatTTL)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Stop ends the beats and removes the process from Sidekiq right away
+// instead of waiting for its entry to expire.
+func (heartbeat *Heartbeat) Stop() error {
+	close(heartbeat.stop)
+
+	conn := heartbeat.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("SREM", namespaced("processes"), identity)
+	conn.Send("DEL", namespaced(identity), namespaced(identity+":workers"))
+	_, err := conn.Do("EXEC")
+	return err
+}
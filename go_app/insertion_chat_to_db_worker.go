@@ -1,39 +1,58 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"time"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
 )
 
-type InsetionChatToDBWorker struct {
-	*Job
-	applicaitonID float64
-	number float64
+type ChatCreationArgs struct {
+	ApplicationID int64 `arg:"application_id"`
+	Number        int64 `arg:"chat_number"`
 }
 
-func (work *InsetionChatToDBWorker) Perform() {
-	db, err := sql.Open("mysql", "instachat:instachat@tcp(instachat_database_development)/instachat_development")
-	if err != nil { panic(err.Error()) }
-
+func (args *ChatCreationArgs) Validate() error {
+	if args.ApplicationID <= 0 || args.Number <= 0 {
+		return fmt.Errorf("application_id and chat_number must be positive")
+	}
+	return nil
+}
 
-	db.SetConnMaxLifetime(time.Minute * 3)
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
+type InsetionChatToDBWorker struct {
+	*Job
+	db *Database
+	applicaitonID int64
+	number int64
+}
 
-	statement, err := db.Prepare("INSERT INTO chats (application_id, number,created_at,updated_at) VALUES (?,?,?,?)")
-	if err != nil { panic(err.Error()) }
+// Perform inserts the chat. A retried job finds its chat already there, as
+// (application_id, number) is unique.
+func (work *InsetionChatToDBWorker) Perform(ctx context.Context) error {
+	result, err := work.db.Exec(ctx, work.Job, "INSERT INTO chats (application_id, number,created_at,updated_at) VALUES (?,?,?,?) ON DUPLICATE KEY UPDATE id = id", work.applicaitonID, work.number, time.Now(), time.Now())
+	if err != nil { return err }
+
+	if added, _ := result.RowsAffected(); added == 0 {
+		work.Logf("Chat %d was already added", work.number)
+		return nil
+	}
+	work.Logf("Added chat: %d", work.number)
+	return nil
+}
 
-	statement.Exec(work.applicaitonID, work.number, time.Now(), time.Now())
+// ChatLane runs the chats of an application one at a time, in number order.
+func ChatLane(job Job) (string, int64, error) {
+	var args ChatCreationArgs
+	if err := DecodeArgs(job, &args); err != nil { return "", 0, err }
 
-	fmt.Printf("Added chat: %f\n", work.number)
+	return fmt.Sprintf("application:%d", args.ApplicationID), args.Number, nil
 }
 
-func NewInsetionChatToDBWorker(job Job) Worker {
-
-	applicaitonID := job.Args[0].(float64)
-	number := job.Args[1].(float64)
+func NewInsetionChatToDBWorker(job Job, args interface{}, services *Services) Worker {
+	chat := args.(*ChatCreationArgs)
+	return &InsetionChatToDBWorker{&job, services.DB, chat.ApplicationID, chat.Number}
+}
 
-   return &InsetionChatToDBWorker{&job, applicaitonID,number}
+func init() {
+	RegisterWorker(WorkerOptions{Class: "ChatCreationWorker", Retry: true, Timeout: 30 * time.Second, Args: ChatCreationArgs{}, New: NewInsetionChatToDBWorker, Lane: ChatLane})
+	RegisterWorker(WorkerOptions{Class: "ChatCreationJob", Queue: "chats", Retry: true, Timeout: 30 * time.Second, Args: ChatCreationArgs{}, New: NewInsetionChatToDBWorker, Lane: ChatLane})
 }
@@ -1,56 +1,109 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"net/http"
 	"io/ioutil"
 	"time"
-	"os"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"errors"
+	"github.com/go-sql-driver/mysql"
 )
 
+type MessageCreationArgs struct {
+	ChatID int64  `arg:"chat_id"`
+	Text   string `arg:"text"`
+	Number int64  `arg:"number"`
+}
+
+func (args *MessageCreationArgs) Validate() error {
+	if args.ChatID <= 0 || args.Number <= 0 {
+		return fmt.Errorf("chat_id and number must be positive")
+	}
+	return nil
+}
+
 type InsetionToDBWorker struct {
 	*Job
-	chatID float64
+	db *Database
+	host string
+	chatID int64
 	newMessage string
-	number float64
+	number int64
 }
 
-func (work *InsetionToDBWorker) Perform() {
-	db, err := sql.Open("mysql", "instachat:instachat@tcp(instachat_database_development)/instachat_development")
-	if err != nil { panic(err.Error()) }
-
-
-	db.SetConnMaxLifetime(time.Minute * 3)
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
+// Perform inserts the message and asks Rails to reindex. A retried job
+// finds its message already there, as (chat_id, number) is unique, and once
+// the message is in a reindex failure no longer fails the job.
+func (work *InsetionToDBWorker) Perform(ctx context.Context) error {
+	result, err := work.db.Exec(ctx, work.Job, "INSERT INTO messages (chat_id, number, text,created_at,updated_at) VALUES (?,?,?,?,?) ON DUPLICATE KEY UPDATE id = id", work.chatID, work.number, work.newMessage, time.Now(), time.Now())
+	if err != nil {
+		if isMissingParentRow(err) {
+			return &DeferError{Reason: fmt.Sprintf("chat %d does not exist yet", work.chatID), Delay: 5 * time.Second}
+		}
+		return err
+	}
+
+	if added, _ := result.RowsAffected(); added == 0 {
+		work.Logf("Message %d was already added", work.number)
+	} else {
+		work.Logf("Added message: %s", work.newMessage)
+	}
+
+	if err := work.reindex(ctx); err != nil {
+		work.Logf("Could not index the message: %s", err)
+	}
+	return nil
+}
 
-	baseUrl := os.Getenv("DEVELOPMENT_HOST")
+// The reindex gets at most this long out of the job's timeout, so a slow
+// search cluster leaves the job time to finish instead of timing it out.
+const reindexTimeout = 10 * time.Second
 
-	statement, err := db.Prepare("INSERT INTO messages (chat_id, number, text,created_at,updated_at) VALUES (?,?,?,?,?)")
-	if err != nil { panic(err.Error()) }
+func (work *InsetionToDBWorker) reindex(ctx context.Context) error {
+	baseUrl := work.host
 
-	statement.Exec(work.chatID, work.number, work.newMessage, time.Now(), time.Now())
+	ctx, cancel := context.WithTimeout(ctx, reindexTimeout)
+	defer cancel()
 
-	fmt.Printf("Added message: %s\n", work.newMessage)
+	request, err := http.NewRequestWithContext(ctx, "GET", baseUrl + "/api/v1/messages/reindex", nil)
+	if err != nil { return err }
+	work.TraceRequest(request)
 
-	resp, err := http.Get(baseUrl + "/api/v1/messages/reindex")
-	if err != nil { panic(err.Error()) }
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil { return err }
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil { panic(err.Error()) }
+	if err != nil { return err }
 
 	sb := string(body)
-	fmt.Printf("Indexed the message: %s\n", sb)
+	work.Logf("Indexed the message: %s", sb)
+
+	return nil
+}
 
+// MessageLane runs the messages of a chat one at a time, in number order.
+func MessageLane(job Job) (string, int64, error) {
+	var args MessageCreationArgs
+	if err := DecodeArgs(job, &args); err != nil { return "", 0, err }
+
+	return fmt.Sprintf("chat:%d", args.ChatID), args.Number, nil
 }
 
-func NewInsetionToDBWorker(job Job) Worker {
+// isMissingParentRow reports MySQL's foreign key error for an insert whose
+// parent row does not exist.
+func isMissingParentRow(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1452
+}
 
-	chatID := job.Args[0].(float64)
-	newMessage := job.Args[1].(string)
-	number := job.Args[2].(float64)
+func NewInsetionToDBWorker(job Job, args interface{}, services *Services) Worker {
+	message := args.(*MessageCreationArgs)
+	return &InsetionToDBWorker{&job, services.DB, services.Config.Host, message.ChatID, message.Text, message.Number}
+}
 
-   return &InsetionToDBWorker{&job, chatID, newMessage,number}
+func init() {
+	RegisterWorker(WorkerOptions{Class: "MessageCreationWorker", Retry: true, Timeout: 30 * time.Second, Args: MessageCreationArgs{}, New: NewInsetionToDBWorker, Lane: MessageLane})
+	RegisterWorker(WorkerOptions{Class: "MessageCreationJob", Retry: true, Timeout: 30 * time.Second, Args: MessageCreationArgs{}, New: NewInsetionToDBWorker, Lane: MessageLane})
 }
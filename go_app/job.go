@@ -1,10 +1,236 @@
 package main
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Job is a Sidekiq job payload. Besides the keys Sidekiq and the Go app
+// know about, it keeps every other key with its raw value and remembers
+// the order keys came in, so a job that is retried, killed or requeued is
+// written back the way Ruby Sidekiq wrote it.
 type Job struct {
-	Retry       bool          `json:retry`
-	Queue       string        `json:queue`
-	Class       string        `json:class`
-	Args        []interface{} `json:args`
-	Jid         string        `json:jid`
-	Enqueued_at float64       `json:enqueued_at`
+	Class          string
+	Wrapped        string
+	Queue          string
+	Args           []json.RawMessage
+	Jid            string
+	Retry          interface{}
+	RetryQueue     string
+	Backtrace      interface{}
+	Dead           *bool
+	Tags           []string
+	Bid            string
+	CreatedAt      float64
+	EnqueuedAt     float64
+	RetryCount     *int
+	ErrorMessage   string
+	ErrorClass     string
+	ErrorBacktrace string
+	FailedAt       float64
+	RetriedAt      float64
+
+	// extra holds the keys not listed above, and keys their original order.
+	extra map[string]json.RawMessage
+	keys  []string
+
+	// original holds the known keys as they were received, so those left
+	// unchanged are written back byte for byte.
+	original map[string]originalValue
+
+	// payload is the JSON the job was fetched as, used to acknowledge it,
+	// and stream and streamID locate it when it came from a stream.
+	payload  []byte
+	stream   string
+	streamID string
+
+	// spanID identifies the current run of the job in its trace.
+	spanID string
+}
+
+// originalValue is a known key's raw JSON, along with how its decoded value
+// encodes, which tells whether the field was changed since.
+type originalValue struct {
+	raw     json.RawMessage
+	decoded []byte
+}
+
+// jobField ties a payload key to the Job field holding its value.
+type jobField struct {
+	key   string
+	value interface{}
+}
+
+// fields lists the known keys in the order Sidekiq writes them.
+func (job *Job) fields() []jobField {
+	return []jobField{
+		{"retry", &job.Retry},
+		{"queue", &job.Queue},
+		{"backtrace", &job.Backtrace},
+		{"dead", &job.Dead},
+		{"retry_queue", &job.RetryQueue},
+		{"tags", &job.Tags},
+		{"class", &job.Class},
+		{"wrapped", &job.Wrapped},
+		{"args", &job.Args},
+		{"jid", &job.Jid},
+		{"bid", &job.Bid},
+		{"created_at", &job.CreatedAt},
+		{"enqueued_at", &job.EnqueuedAt},
+		{"error_message", &job.ErrorMessage},
+		{"error_class", &job.ErrorClass},
+		{"failed_at", &job.FailedAt},
+		{"retry_count", &job.RetryCount},
+		{"retried_at", &job.RetriedAt},
+		{"error_backtrace", &job.ErrorBacktrace},
+	}
+}
+
+func (job *Job) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return fmt.Errorf("job payload is not a JSON object")
+	}
+
+	*job = Job{extra: make(map[string]json.RawMessage), original: make(map[string]originalValue)}
+	known := make(map[string]interface{})
+	for _, field := range job.fields() {
+		known[field.key] = field.value
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key := token.(string)
+
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+
+		// A repeated key keeps its first position and its last value, like
+		// a Ruby hash built by JSON.parse.
+		_, seen := job.original[key]
+		if _, ok := job.extra[key]; ok {
+			seen = true
+		}
+		if !seen {
+			job.keys = append(job.keys, key)
+		}
+
+		if value, ok := known[key]; ok {
+			if err := json.Unmarshal(raw, value); err != nil {
+				return fmt.Errorf("job key %q: %s", key, err)
+			}
+			decoded, err := dumpJSON(value)
+			if err != nil {
+				return err
+			}
+			job.original[key] = originalValue{raw: raw, decoded: decoded}
+		} else {
+			job.extra[key] = raw
+		}
+	}
+	return nil
+}
+
+func (job Job) MarshalJSON() ([]byte, error) {
+	values := make(map[string]json.RawMessage)
+	present := make(map[string]bool)
+	for _, key := range job.keys {
+		present[key] = true
+	}
+
+	var order []string
+	order = append(order, job.keys...)
+	for _, field := range job.fields() {
+		// Unset keys are only written if the job already had them, so a
+		// `"retry": false` or `"tags": []` survives the round trip.
+		if !present[field.key] && reflect.ValueOf(field.value).Elem().IsZero() && field.key != "args" {
+			continue
+		}
+
+		raw, err := dumpJSON(field.value)
+		if err != nil {
+			return nil, err
+		}
+		if original, ok := job.original[field.key]; ok && bytes.Equal(raw, original.decoded) {
+			raw = original.raw
+		} else if field.key == "args" && job.Args == nil {
+			raw = []byte("[]")
+		}
+		values[field.key] = raw
+		if !present[field.key] {
+			order = append(order, field.key)
+		}
+	}
+	for key, raw := range job.extra {
+		values[key] = raw
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range order {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := dumpJSON(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(values[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Set stores a custom key on the job, e.g. for middleware to pass data
+// along with it to retries.
+func (job *Job) Set(key string, value interface{}) error {
+	raw, err := dumpJSON(value)
+	if err != nil {
+		return err
+	}
+	for _, field := range job.fields() {
+		if field.key == key {
+			return json.Unmarshal(raw, field.value)
+		}
+	}
+
+	// Copies of a job share extra and keys, so they are copied on write.
+	extra := make(map[string]json.RawMessage, len(job.extra)+1)
+	for k, v := range job.extra {
+		extra[k] = v
+	}
+	if _, ok := extra[key]; !ok {
+		job.keys = append(job.keys[:len(job.keys):len(job.keys)], key)
+	}
+	extra[key] = raw
+	job.extra = extra
+	return nil
+}
+
+// Get decodes a custom key of the job into target and reports whether the
+// job has that key.
+func (job *Job) Get(key string, target interface{}) (bool, error) {
+	raw, ok := job.extra[key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, target)
+}
+
+// dumpJSON encodes payloads the way Ruby's JSON.generate does, without
+// escaping <, > and & into \u sequences.
+func dumpJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJobRoundTrip(t *testing.T) {
+	// Payloads are compact like the ones Sidekiq writes; encoding/json
+	// compacts whatever MarshalJSON returns.
+	payloads := []string{
+		`{"class":"MessageCreationWorker","args":[1,"hi",2],"retry":true,"queue":"default","jid":"b4a577edbccf1d805744efa9","created_at":1602850000.1234567,"enqueued_at":1602850000.1234567}`,
+		`{"retry":true,"queue":"default","class":"ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper","wrapped":"ChatCreationJob","args":[{"job_class":"ChatCreationJob","arguments":[{"application_id":5}]}],"jid":"abc"}`,
+		`{"class":"X","args":[],"bid":null,"error_message":null,"retry_count":null}`,
+		`{"class":"X","args":[],"created_at":1602850000.0,"enqueued_at":1.6028500001e9}`,
+		`{"class":"X","args":[1,"a&<b>"],"retry":false,"tags":[],"dead":false}`,
+		`{"class":"X","args":[],"retry":5,"backtrace":true,"retry_queue":"low"}`,
+		`{"class":"X","args":[],"custom":{"nested":[1,2.50,"é"]},"traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`,
+		`{"class":"X","args":null}`,
+		`{"jid":"abc","class":"X","args":[],"error_class":"RuntimeError","failed_at":1602850000,"retried_at":1602850100.5,"error_backtrace":"eJwLyUgtSgUABJ8B1g=="}`,
+	}
+
+	for _, payload := range payloads {
+		var job Job
+		if err := json.Unmarshal([]byte(payload), &job); err != nil {
+			t.Errorf("%s: %s", payload, err)
+			continue
+		}
+		got, err := dumpJSON(job)
+		if err != nil {
+			t.Errorf("%s: %s", payload, err)
+			continue
+		}
+		if string(got) != payload {
+			t.Errorf("round trip changed the payload\n got: %s\nwant: %s", got, payload)
+		}
+	}
+}
+
+func TestJobRoundTripChanges(t *testing.T) {
+	tests := []struct {
+		payload string
+		change  func(job *Job)
+		want    string
+	}{
+		{
+			payload: `{"class":"X","args":[],"a":1,"a":2}`,
+			change:  func(job *Job) {},
+			want:    `{"class":"X","args":[],"a":2}`,
+		},
+		{
+			payload: `{"class":"X","queue":"a","args":[],"queue":"b"}`,
+			change:  func(job *Job) {},
+			want:    `{"class":"X","queue":"b","args":[]}`,
+		},
+		{
+			payload: `{"class":"X","args":[],"enqueued_at":1602850000.0}`,
+			change:  func(job *Job) { job.EnqueuedAt = 1602850001.5 },
+			want:    `{"class":"X","args":[],"enqueued_at":1602850001.5}`,
+		},
+		{
+			payload: `{"class":"X","args":[],"bid":null}`,
+			change: func(job *Job) {
+				count := 0
+				job.RetryCount = &count
+				job.ErrorMessage = "boom"
+			},
+			want: `{"class":"X","args":[],"bid":null,"error_message":"boom","retry_count":0}`,
+		},
+		{
+			payload: `{"class":"X","args":[]}`,
+			change:  func(job *Job) { job.Set("deferred_count", 1) },
+			want:    `{"class":"X","args":[],"deferred_count":1}`,
+		},
+	}
+
+	for _, test := range tests {
+		var job Job
+		if err := json.Unmarshal([]byte(test.payload), &job); err != nil {
+			t.Errorf("%s: %s", test.payload, err)
+			continue
+		}
+		test.change(&job)
+		got, err := dumpJSON(job)
+		if err != nil {
+			t.Errorf("%s: %s", test.payload, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s\n got: %s\nwant: %s", test.payload, got, test.want)
+		}
+	}
+}
+
+func TestJobSetCopyOnWrite(t *testing.T) {
+	var job Job
+	if err := json.Unmarshal([]byte(`{"class":"X","args":[],"a":1}`), &job); err != nil {
+		t.Fatal(err)
+	}
+	copied := job
+	copied.Set("a", 2)
+	copied.Set("b", 3)
+
+	got, _ := dumpJSON(job)
+	if string(got) != `{"class":"X","args":[],"a":1}` {
+		t.Errorf("Set on a copy changed the original job: %s", got)
+	}
+}
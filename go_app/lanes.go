@@ -0,0 +1,199 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// How many fetched jobs may wait per unit of concurrency. Once that many
+// wait across all lanes, PerformJobs stops taking jobs and ListenForJobs
+// blocks instead of fetching more.
+const laneBuffer = 8
+
+// A LaneFunc names the key whose jobs must run one after another, like
+// "chat:42" for the messages of a chat, and the job's position in that
+// key's sequence.
+type LaneFunc func(Job) (key string, sequence int64, err error)
+
+// laneFor names the lane of a job. Jobs of the same key share a lane and
+// so never run concurrently; jobs without a key get a lane of their own.
+func (processor *Processor) laneFor(job Job) (string, int64) {
+	key, sequence := "jid:"+job.Jid, int64(0)
+
+	if unwrapped, err := UnwrapActiveJob(job); err == nil {
+		if options, ok := processor.workers[unwrapped.Class]; ok && options.Lane != nil {
+			if k, s, err := options.Lane(unwrapped); err == nil {
+				key, sequence = k, s
+			}
+		}
+	}
+	return key, sequence
+}
+
+// laneJob is a job waiting in a lane with its key and sequence.
+type laneJob struct {
+	job      Job
+	key      string
+	sequence int64
+}
+
+// lane holds the waiting jobs of one key, lowest sequence first.
+type lane struct {
+	key     string
+	pending []laneJob
+	running bool
+}
+
+// lanes runs the jobs of every key one at a time. Any idle worker takes
+// the next lane that has a job waiting and nothing running, so a busy key
+// only ever holds up its own jobs.
+//
+// Ordering is best effort: jobs of a key run lowest sequence first among
+// those waiting, but a job that is retried or deferred comes back after
+// later ones may already have run.
+type lanes struct {
+	mu       sync.Mutex
+	changed  *sync.Cond
+	byKey    map[string]*lane
+	ready    []*lane
+	waiting  int
+	capacity int
+	closed   bool
+}
+
+func newLanes(capacity int) *lanes {
+	lanes := &lanes{byKey: make(map[string]*lane), capacity: capacity}
+	lanes.changed = sync.NewCond(&lanes.mu)
+	return lanes
+}
+
+// add puts a job in its key's lane, waiting while the lanes are full. It
+// returns false, without adding the job, once the lanes are closed.
+func (lanes *lanes) add(waiting laneJob) bool {
+	lanes.mu.Lock()
+	defer lanes.mu.Unlock()
+
+	for lanes.waiting >= lanes.capacity && !lanes.closed {
+		lanes.changed.Wait()
+	}
+	if lanes.closed {
+		return false
+	}
+
+	l, ok := lanes.byKey[waiting.key]
+	if !ok {
+		l = &lane{key: waiting.key}
+		lanes.byKey[waiting.key] = l
+	}
+
+	i := sort.Search(len(l.pending), func(i int) bool {
+		return l.pending[i].sequence > waiting.sequence
+	})
+	l.pending = append(l.pending, laneJob{})
+	copy(l.pending[i+1:], l.pending[i:])
+	l.pending[i] = waiting
+
+	lanes.waiting++
+	if !l.running && len(l.pending) == 1 {
+		lanes.ready = append(lanes.ready, l)
+	}
+	lanes.changed.Broadcast()
+	return true
+}
+
+// take waits for the next job of a lane that is free to run, and marks the
+// lane as running. It returns false once the lanes are closed.
+func (lanes *lanes) take() (*lane, laneJob, bool) {
+	lanes.mu.Lock()
+	defer lanes.mu.Unlock()
+
+	for len(lanes.ready) == 0 && !lanes.closed {
+		lanes.changed.Wait()
+	}
+	if lanes.closed {
+		return nil, laneJob{}, false
+	}
+
+	l := lanes.ready[0]
+	lanes.ready = lanes.ready[1:]
+	next := l.pending[0]
+	l.pending = l.pending[1:]
+	l.running = true
+
+	lanes.waiting--
+	lanes.changed.Broadcast()
+	return l, next, true
+}
+
+// finish frees a lane after its job ran, putting it back in line when more
+// of its jobs are waiting.
+func (lanes *lanes) finish(l *lane) {
+	lanes.mu.Lock()
+	defer lanes.mu.Unlock()
+
+	l.running = false
+	if len(l.pending) > 0 {
+		lanes.ready = append(lanes.ready, l)
+	} else if lanes.byKey[l.key] == l {
+		delete(lanes.byKey, l.key)
+	}
+	lanes.changed.Broadcast()
+}
+
+// close stops add and take, waking whoever is waiting in them.
+func (lanes *lanes) close() {
+	lanes.mu.Lock()
+	defer lanes.mu.Unlock()
+
+	lanes.closed = true
+	lanes.changed.Broadcast()
+}
+
+// takeWaiting empties the lanes of every job that has not started, each
+// lane's jobs in the order they would have run.
+func (lanes *lanes) takeWaiting() []laneJob {
+	lanes.mu.Lock()
+	defer lanes.mu.Unlock()
+
+	var waiting []laneJob
+	for _, l := range lanes.byKey {
+		waiting = append(waiting, l.pending...)
+		l.pending = nil
+	}
+	lanes.ready = nil
+	lanes.waiting = 0
+	lanes.changed.Broadcast()
+	return waiting
+}
+
+// runLanes performs jobs from the lanes until they are closed.
+func (processor *Processor) runLanes(lanes *lanes) {
+	for {
+		l, next, ok := lanes.take()
+		if !ok {
+			return
+		}
+		processor.perform(next.job)
+		lanes.finish(l)
+	}
+}
+
+// requeueJobs gives back jobs a lane did not get to before shutdown. They
+// are pushed last first, so the job that was next in line is fetched first
+// again.
+func (processor *Processor) requeueJobs(batch []laneJob) {
+	if len(batch) == 0 {
+		return
+	}
+
+	conn := processor.pool.Get()
+	defer conn.Close()
+
+	for i := len(batch) - 1; i >= 0; i-- {
+		job := batch[i].job
+		processor.queues.Release(job.Queue)
+		if err := processor.fetcher.Requeue(conn, job); err != nil {
+			job.Logf("could not requeue: %s", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func addJobs(t *testing.T, lanes *lanes, jobs ...laneJob) {
+	t.Helper()
+	for _, job := range jobs {
+		if !lanes.add(job) {
+			t.Fatalf("could not add %s:%d", job.key, job.sequence)
+		}
+	}
+}
+
+func TestLanesRunKeyInSequence(t *testing.T) {
+	lanes := newLanes(8)
+	addJobs(t, lanes,
+		laneJob{key: "chat:1", sequence: 3},
+		laneJob{key: "chat:1", sequence: 1},
+		laneJob{key: "chat:1", sequence: 2},
+	)
+
+	var sequences []int64
+	for i := 0; i < 3; i++ {
+		l, next, ok := lanes.take()
+		if !ok {
+			t.Fatal("lanes closed")
+		}
+		sequences = append(sequences, next.sequence)
+		lanes.finish(l)
+	}
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(sequences, want) {
+		t.Errorf("ran %v, want %v", sequences, want)
+	}
+}
+
+func TestLanesBusyKeyDoesNotBlockOthers(t *testing.T) {
+	lanes := newLanes(8)
+	addJobs(t, lanes,
+		laneJob{key: "chat:1", sequence: 1},
+		laneJob{key: "chat:1", sequence: 2},
+		laneJob{key: "chat:1", sequence: 3},
+		laneJob{key: "chat:2", sequence: 1},
+	)
+
+	busy, first, _ := lanes.take()
+	if first.key != "chat:1" {
+		t.Fatalf("took %s first", first.key)
+	}
+
+	// chat:1 is running, so the next free worker gets chat:2 rather than
+	// waiting behind it.
+	other, next, _ := lanes.take()
+	if next.key != "chat:2" {
+		t.Fatalf("took %s:%d while chat:1 was running", next.key, next.sequence)
+	}
+	lanes.finish(other)
+	lanes.finish(busy)
+
+	_, next, _ = lanes.take()
+	if next.key != "chat:1" || next.sequence != 2 {
+		t.Errorf("took %s:%d, want chat:1:2", next.key, next.sequence)
+	}
+}
+
+func TestLanesCapacity(t *testing.T) {
+	lanes := newLanes(2)
+	addJobs(t, lanes, laneJob{key: "a"}, laneJob{key: "b"})
+
+	added := make(chan bool)
+	go func() { added <- lanes.add(laneJob{key: "c"}) }()
+
+	select {
+	case <-added:
+		t.Fatal("added a job to full lanes")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l, _, _ := lanes.take()
+	if !<-added {
+		t.Fatal("job was not added once a lane was taken")
+	}
+	lanes.finish(l)
+
+	// The lanes are full again, so this add waits until they are closed.
+	go func() { added <- lanes.add(laneJob{key: "d"}) }()
+	lanes.close()
+	if <-added {
+		t.Error("added a job to closed lanes")
+	}
+	if _, _, ok := lanes.take(); ok {
+		t.Error("took a job from closed lanes")
+	}
+}
+
+func TestLanesTakeWaiting(t *testing.T) {
+	lanes := newLanes(8)
+	addJobs(t, lanes,
+		laneJob{key: "chat:1", sequence: 2},
+		laneJob{key: "chat:1", sequence: 1},
+	)
+
+	l, _, _ := lanes.take()
+	waiting := lanes.takeWaiting()
+	if len(waiting) != 1 || waiting[0].sequence != 2 {
+		t.Errorf("waiting %v, want chat:1:2", waiting)
+	}
+	lanes.finish(l)
+
+	addJobs(t, lanes, laneJob{key: "chat:1", sequence: 3})
+	if _, next, _ := lanes.take(); next.sequence != 3 {
+		t.Errorf("took %d after takeWaiting, want 3", next.sequence)
+	}
+}
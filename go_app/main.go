@@ -1,97 +1,489 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"github.com/garyburd/redigo/redis"
 	"fmt"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// Sidekiq is configured with `namespace: 'instachat'`, so every key it
+// reads or writes is prefixed accordingly.
+const namespace = "instachat"
 
-func connect() (redis.Conn, error) {
-	redisUrl := os.Getenv("DEVELOPMENT_REDIS_URL_GO_APP")
-	fmt.Println("redisUrlredisUrlredisUrlredisUrl.", redisUrl)
+func namespaced(key string) string {
+	return namespace + ":" + key
+}
 
+// connect dials Redis at a redis:// URL or a bare host:port.
+func connect(redisUrl string) (redis.Conn, error) {
+	if strings.Contains(redisUrl, "://") {
+		return redis.DialURL(redisUrl)
+	}
 	return redis.Dial("tcp", redisUrl)
 }
 
-func ListenForJobs(jobs chan Job) {
+func newPool(redisUrl string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial:        func() (redis.Conn, error) { return connect(redisUrl) },
+	}
+}
+
+// ListenForJobs fetches jobs and hands them to the workers until done is
+// closed. A job fetched while shutting down is put back on its queue, as
+// are jobs the fetcher holds on to.
+func ListenForJobs(jobs chan Job, done chan struct{}, pool *redis.Pool, fetcher Fetcher, queues *Queues) {
+	defer releaseFetched(pool, fetcher)
+
 	// connect to redis
-	conn, err := connect()
-	if err != nil { panic(err.Error()) }
-	defer conn.Close()
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
-	fmt.Println("Waiting for jobs...")
+	conn := pool.Get()
+	defer func() { conn.Close() }()
+	backoff := time.Duration(0)
 	fmt.Println("Waiting for jobs...")
 
 	for {
-		reply, err := redis.Values(conn.Do("blpop", "instachat:queue:default", 0))
-		if err != nil { panic(err.Error())  }
+		select {
+		case <-done:
+			return
+		default:
+		}
 
-		var queue string
-		var body []byte
-		if _, err := redis.Scan(reply, &queue, &body); err != nil {
-			fmt.Println(err)
+		job, err := fetcher.Fetch(conn)
+		if err == redis.ErrNil { continue }
+
+		var malformed *MalformedJobError
+		if errors.As(err, &malformed) {
+			fmt.Printf("Killing unreadable job: %s\n", malformed.Err)
+			if err := KillPayload(conn, malformed.Payload); err == nil {
+				fetcher.Acknowledge(conn, job)
+			}
+			continue
+		}
+		if err != nil {
+			// The connection may be broken; hand it back and retry on a
+			// fresh one after backing off.
+			backoff = fetchBackoff(backoff)
+			fmt.Printf("Could not fetch jobs, retrying in %s: %s\n", backoff, err)
+			conn.Close()
+			select {
+			case <-time.After(backoff):
+			case <-done:
+				return
+			}
+			conn = pool.Get()
+			continue
 		}
-		job := new(Job)
+		backoff = 0
+
+		job.Logf("found job")
+
+		queues.Acquire(job.Queue)
+		select {
+		case jobs <- job:
+		case <-done:
+			queues.Release(job.Queue)
+			if err := fetcher.Requeue(conn, job); err != nil {
+				job.Logf("could not requeue: %s", err)
+			}
+			return
+		}
+	}
+}
 
-		err = json.Unmarshal(body, &job)
-		if err != nil { panic(err.Error()) }
+func releaseFetched(pool *redis.Pool, fetcher Fetcher) {
+	releasing, ok := fetcher.(releasingFetcher)
+	if !ok {
+		return
+	}
 
-		fmt.Printf("Found job: %s(%s)\n", job.Class, job.Jid)
+	conn := pool.Get()
+	defer conn.Close()
+
+	if err := releasing.Release(conn); err != nil {
+		fmt.Printf("Could not requeue fetched jobs: %s\n", err)
+	}
+}
 
-		jobs <- *job
+// fetchBackoff doubles the wait after a failed fetch, from one second up
+// to thirty.
+func fetchBackoff(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return time.Second
+	}
+	if previous*2 > 30*time.Second {
+		return 30 * time.Second
 	}
+	return previous * 2
 }
 
-type WorkerFactory func(Job) Worker
+// Processor holds everything a job needs on its way through the consumer.
+type Processor struct {
+	pool        *redis.Pool
+	fetcher     Fetcher
+	heartbeat   *Heartbeat
+	queues      *Queues
+	concurrency int
+	workers     map[string]*WorkerOptions
+	middleware  MiddlewareChain
+
+	// slots holds a semaphore for every class with a concurrency cap.
+	slots map[string]chan struct{}
+
+	// services are handed to every worker built.
+	services *Services
+
+	// unknownQueue receives jobs without a Go worker; they are killed when
+	// it is empty.
+	unknownQueue string
+
+	mu         sync.Mutex
+	inProgress map[string]Job
+	lanes      *lanes
+}
+
+func NewProcessor(pool *redis.Pool, fetcher Fetcher, heartbeat *Heartbeat, queues *Queues, concurrency int, unknownQueue string, services *Services) *Processor {
+	workers := make(map[string]*WorkerOptions)
+	slots := make(map[string]chan struct{})
+
+	for _, options := range registeredWorkers() {
+		workers[options.Class] = options
+		if options.Concurrency > 0 {
+			slots[options.Class] = make(chan struct{}, options.Concurrency)
+		}
+	}
+
+	return &Processor{
+		pool:         pool,
+		fetcher:      fetcher,
+		heartbeat:    heartbeat,
+		queues:       queues,
+		concurrency:  concurrency,
+		workers:      workers,
+		slots:        slots,
+		services:     services,
+		unknownQueue: unknownQueue,
+		inProgress:   make(map[string]Job),
+	}
+}
 
-func PerformJobs(jobs chan Job) {
-	workers := make(map[string]WorkerFactory)
+// PerformJobs runs jobs on as many workers as the concurrency allows until
+// done is closed and the jobs the workers are busy with are finished. Jobs
+// of the same chat or application wait in the same lane and run one after
+// another, in sequence order as far as they arrive in it. Once the lanes
+// are full ListenForJobs blocks instead of fetching more.
+func PerformJobs(jobs chan Job, done chan struct{}, processor *Processor) {
+	var wg sync.WaitGroup
 
-	workers["MessageCreationWorker"] = NewInsetionToDBWorker
-	workers["ChatCreationWorker"] = NewInsetionChatToDBWorker
+	lanes := newLanes(processor.concurrency * laneBuffer)
+	processor.mu.Lock()
+	processor.lanes = lanes
+	processor.mu.Unlock()
+
+	for i := 0; i < processor.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			processor.runLanes(lanes)
+		}()
+	}
+
+	go func() {
+		<-done
+		lanes.close()
+	}()
 
 	for {
-		// wait for a job
+		select {
+		case job := <-jobs:
+			key, sequence := processor.laneFor(job)
+			if !lanes.add(laneJob{job, key, sequence}) {
+				processor.requeueJobs([]laneJob{{job, key, sequence}})
+			}
+		case <-done:
+			wg.Wait()
+			processor.requeueJobs(lanes.takeWaiting())
+			return
+		}
+	}
+}
+
+func (processor *Processor) perform(job Job) {
+	defer processor.queues.Release(job.Queue)
+
+	tid := processor.heartbeat.Started(job)
+	defer processor.heartbeat.Finished(tid)
+
+	processor.mu.Lock()
+	processor.inProgress[tid] = job
+	processor.mu.Unlock()
 
-		job := <-jobs
+	err := processor.run(&job)
 
-		factory := workers[job.Class]
-		worker := factory(job)
+	// From here on the job is accounted for, and must not be requeued.
+	processor.mu.Lock()
+	delete(processor.inProgress, tid)
+	processor.mu.Unlock()
 
-		go worker.Perform()
+	conn := processor.pool.Get()
+	defer conn.Close()
+
+	if err := RecordStats(conn, processor.isFailure(err)); err != nil {
+		job.Logf("could not record stats: %s", err)
+	}
+
+	if err != nil {
+		if err := processor.handOff(conn, job, err); err != nil {
+			// Leave the job unacknowledged so a reliable fetcher can recover it.
+			job.Logf("could not hand off: %s", err)
+			return
+		}
+	}
+
+	if err := processor.fetcher.Acknowledge(conn, job); err != nil {
+		job.Logf("could not acknowledge: %s", err)
+	}
+}
+
+// isFailure tells whether a job's error counts as failed in the stats.
+// Deferred and expired jobs do not, nor do unknown jobs forwarded to the
+// fallback queue, which count once they are performed there.
+func (processor *Processor) isFailure(err error) bool {
+	var deferral *DeferError
+	var expired *ExpiredError
+	var unknown *UnknownJobError
+	if errors.As(err, &unknown) && processor.unknownQueue != "" {
+		return false
+	}
+	return err != nil && !errors.As(err, &deferral) && !errors.As(err, &expired)
+}
+
+// handOff sends a job that did not complete to wherever its error calls
+// for: back to the schedule, the fallback queue, the dead set or a retry.
+func (processor *Processor) handOff(conn redis.Conn, job Job, err error) error {
+	var deferral *DeferError
+	var expired *ExpiredError
+	var unknown *UnknownJobError
+
+	switch {
+	case errors.As(err, &deferral):
+		return DeferJob(conn, job, deferral)
+	case errors.As(err, &expired):
+		return ExpireJob(conn, job, expired)
+	}
+
+	job.Logf("failed: %s", err)
+	if errors.As(err, &unknown) {
+		return RouteUnknownJob(conn, job, err, processor.unknownQueue)
+	}
+	return RetryJob(conn, job, err)
+}
+
+// run builds the worker for the job and performs it through the middleware
+// chain, turning a panic in any step into an error for this job alone.
+func (processor *Processor) run(job *Job) (err error) {
+	job.spanID = newSpanID()
+
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+			job.Logf("panicked: %v\n%s", r, panicErr.Stack)
+			err = panicErr
+		}
+	}()
+
+	unwrapped, err := UnwrapActiveJob(*job)
+	if err != nil {
+		return err
+	}
+
+	options, ok := processor.workers[unwrapped.Class]
+	if !ok {
+		return &UnknownJobError{Class: unwrapped.Class}
+	}
+	if err := options.applyDefaults(job); err != nil {
+		return err
+	}
+
+	worker, err := options.factory(unwrapped, processor.services)
+	if err != nil {
+		return err
+	}
+
+	if slots, ok := processor.slots[unwrapped.Class]; ok {
+		slots <- struct{}{}
+		defer func() { <-slots }()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if options.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), options.Timeout)
+	}
+	defer cancel()
+
+	return processor.middleware.Invoke(worker, job, func() error {
+		err := worker.Perform(ctx)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return &TimeoutError{Timeout: options.Timeout, Err: err}
+		}
+		return err
+	})
+}
+
+// Use adds a server middleware around every job this processor performs.
+func (processor *Processor) Use(middleware Middleware) {
+	processor.middleware.Use(middleware)
+}
+
+// RequeueInProgress puts the jobs still running after the shutdown timeout
+// back on their queues so another process picks them up, along with the
+// jobs still waiting in the lanes behind them.
+func (processor *Processor) RequeueInProgress() {
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+
+	if processor.lanes != nil {
+		processor.requeueJobs(processor.lanes.takeWaiting())
+	}
+
+	conn := processor.pool.Get()
+	defer conn.Close()
+
+	for _, job := range processor.inProgress {
+		if err := processor.fetcher.Requeue(conn, job); err != nil {
+			job.Logf("could not requeue: %s", err)
+			continue
+		}
+		job.Logf("requeued unfinished job")
+	}
+}
+
+func loadQueues(config *Config) *Queues {
+	queues, err := ParseQueues(config.QueueSpec())
+	if err != nil { panic(err.Error()) }
+
+	if err := queues.SetLimits(config.QueueLimits); err != nil { panic(err.Error()) }
+	return queues
+}
+
+// newFetcher picks the queue backend: Redis Streams when queue_backend is
+// "streams", lists otherwise, fetched reliably when reliable_fetch is set.
+func newFetcher(pool *redis.Pool, queues *Queues, config *Config, done chan struct{}) Fetcher {
+	var fetcher Fetcher
+	var err error
+
+	switch {
+	case config.QueueBackend == "streams":
+		fetcher, err = NewStreamFetch(pool, queues, streamGroup, config.Concurrency)
+	case config.ReliableFetch:
+		fetcher, err = NewReliableFetch(pool, queues, done)
+	default:
+		fetcher = NewBasicFetch(queues)
+	}
+	if err != nil { panic(err.Error()) }
+	return fetcher
+}
+
+// queueCommand runs an operator command such as `pause default` instead of
+// the consumer. It only needs to read queue sizes, so it does not set up
+// a fetcher that registers itself or recovers jobs.
+func queueCommand(pool *redis.Pool, queues *Queues, config *Config, args []string) {
+	var fetcher Fetcher = NewBasicFetch(queues)
+	if config.QueueBackend == "streams" {
+		fetcher = &streamFetch{queues: queues, group: streamGroup}
+	}
+
+	if err := RunQueueCommand(pool, fetcher, args); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
 
 func main() {
-   for{
+	config, err := LoadConfig()
+	if err != nil { panic(err.Error()) }
+
+	pool := newPool(config.RedisURL)
+	defer pool.Close()
+
+	queues := loadQueues(config)
+	if len(os.Args) > 1 {
+		queueCommand(pool, queues, config, os.Args[1:])
+		return
+	}
+
+	done := make(chan struct{})
+	fetcher := newFetcher(pool, queues, config, done)
+	concurrency := config.Concurrency
+
+	heartbeat := NewHeartbeat(pool, queues, concurrency)
+	go heartbeat.Run()
+
+	db, err := OpenDatabase(config.Database)
+	if err != nil { panic(err.Error()) }
+
+	processor := NewProcessor(pool, fetcher, heartbeat, queues, concurrency, config.UnknownJobsQueue, &Services{Config: config, DB: db})
+	processor.Use(JobLogger)
+
+	ttls, err := ParseJobTTLs(config.JobTTLs)
+	if err != nil { panic(err.Error()) }
+	processor.Use(ExpiryMiddleware(ttls))
+
 	jobs := make(chan Job)
-	go ListenForJobs(jobs)
-	go PerformJobs(jobs)
+	go PollScheduledJobs(pool, fetcher, done)
+	WatchQueueControls(pool, queues, fetcher, done)
+	listened := make(chan struct{})
+	go func() {
+		ListenForJobs(jobs, done, pool, fetcher, queues)
+		close(listened)
+	}()
+
+	periodicJobs, err := ParsePeriodicJobs(config.CronJobs)
+	if err != nil { panic(err.Error()) }
+
+	cron := NewCronScheduler(pool)
+	for _, job := range periodicJobs {
+		cron.Register(job)
+	}
+	go cron.Run(done)
+	go db.MonitorHealth(done)
+
+	drained := make(chan struct{})
+	go func() {
+		PerformJobs(jobs, done, processor)
+		close(drained)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Printf("Shutting down after %s\n", <-signals)
 
-	fmt.Println("Press Enter to Exit.")
-	var userInput string
-	fmt.Scanln(&userInput)
-   }
+	close(done)
+	heartbeat.Quiet()
+
+	select {
+	case <-drained:
+		fmt.Println("All jobs finished")
+	case <-time.After(config.ShutdownTimeout):
+		processor.RequeueInProgress()
+	}
+
+	// A job fetched while shutting down is put back before the process
+	// exits; the fetch it is in returns within the fetch timeout.
+	<-listened
+
+	if err := heartbeat.Stop(); err != nil {
+		fmt.Printf("Could not unregister process: %s\n", err)
+	}
+	if err := db.Close(); err != nil {
+		fmt.Printf("Could not close the database: %s\n", err)
+	}
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+)
+
+// Middleware wraps the performing of a job, like a Sidekiq server
+// middleware's `call(worker, job, queue) { yield }`. It calls next to go on
+// down the chain and returns its error; it can also skip the job by not
+// calling next, swallow a failure by returning nil, or fail (and so retry)
+// a job by returning an error of its own.
+type Middleware func(worker Worker, job *Job, next func() error) error
+
+// MiddlewareChain runs middleware in the order it was added, the first one
+// being the outermost.
+type MiddlewareChain struct {
+	entries []Middleware
+}
+
+func (chain *MiddlewareChain) Use(middleware Middleware) {
+	chain.entries = append(chain.entries, middleware)
+}
+
+// Invoke runs perform wrapped in every middleware of the chain.
+func (chain *MiddlewareChain) Invoke(worker Worker, job *Job, perform func() error) error {
+	var call func(i int) error
+	call = func(i int) error {
+		if i == len(chain.entries) {
+			return perform()
+		}
+		return chain.entries[i](worker, job, func() error {
+			return call(i + 1)
+		})
+	}
+	return call(0)
+}
+
+// JobLogger logs when a job starts and how long it took, like Sidekiq's
+// JobLogger.
+func JobLogger(worker Worker, job *Job, next func() error) error {
+	start := time.Now()
+	job.Logf("start")
+
+	err := next()
+
+	elapsed := time.Since(start).Seconds()
+	if err != nil {
+		job.Logf("fail: %.3f sec", elapsed)
+	} else {
+		job.Logf("done: %.3f sec", elapsed)
+	}
+	return err
+}
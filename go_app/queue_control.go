@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// States a queue can be put in through the `queue-control` hash. A queue
+// without an entry is consumed normally. A draining queue is consumed
+// until it is empty and then paused.
+const (
+	queuePaused   = "paused"
+	queueDraining = "draining"
+)
+
+// How often consumers pick up changes to the queue controls.
+const queueControlInterval = 2 * time.Second
+
+func queueControlKey() string {
+	return namespaced("queue-control")
+}
+
+func PauseQueue(conn redis.Conn, queue string) error {
+	_, err := conn.Do("HSET", queueControlKey(), queue, queuePaused)
+	return err
+}
+
+func ResumeQueue(conn redis.Conn, queue string) error {
+	_, err := conn.Do("HDEL", queueControlKey(), queue)
+	return err
+}
+
+func DrainQueue(conn redis.Conn, queue string) error {
+	_, err := conn.Do("HSET", queueControlKey(), queue, queueDraining)
+	return err
+}
+
+func QueueStates(conn redis.Conn) (map[string]string, error) {
+	return redis.StringMap(conn.Do("HGETALL", queueControlKey()))
+}
+
+// WatchQueueControls keeps the paused queues of queues in line with the
+// `queue-control` hash until done is closed, and pauses draining queues
+// once they are empty, so every Go instance stops fetching from them
+// within a couple of seconds without being restarted. The controls are
+// applied once before it returns, so nothing is fetched from a queue that
+// was paused before the process started.
+func WatchQueueControls(pool *redis.Pool, queues *Queues, fetcher Fetcher, done chan struct{}) {
+	apply := func() {
+		conn := pool.Get()
+		defer conn.Close()
+
+		if err := applyQueueControls(conn, queues, fetcher); err != nil {
+			fmt.Printf("Could not read queue controls: %s\n", err)
+		}
+	}
+
+	apply()
+	go func() {
+		for {
+			select {
+			case <-time.After(queueControlInterval):
+				apply()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func applyQueueControls(conn redis.Conn, queues *Queues, fetcher Fetcher) error {
+	states, err := QueueStates(conn)
+	if err != nil {
+		return err
+	}
+
+	paused := make(map[string]bool)
+	for queue, state := range states {
+		switch state {
+		case queuePaused:
+			paused[queue] = true
+		case queueDraining:
+			size, err := fetcher.Size(conn, queue)
+			if err != nil {
+				return err
+			}
+			if size == 0 {
+				// Only pause if nobody resumed the queue in the meantime.
+				if _, err := drainedScript.Do(conn, queueControlKey(), queue); err != nil {
+					return err
+				}
+				fmt.Printf("Queue %s is drained and now paused\n", queue)
+				paused[queue] = true
+			}
+		}
+	}
+
+	queues.SetPaused(paused)
+	return nil
+}
+
+var drainedScript = redis.NewScript(1, `
+if redis.call('hget', KEYS[1], ARGV[1]) == 'draining' then
+  redis.call('hset', KEYS[1], ARGV[1], 'paused')
+end
+return 0
+`)
+
+// RunQueueCommand handles `pause <queue>`, `resume <queue>`,
+// `drain <queue>` and `status`, the operator commands of the binary.
+func RunQueueCommand(pool *redis.Pool, fetcher Fetcher, args []string) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	command := args[0]
+	if command == "status" {
+		return printQueueStatus(conn, fetcher)
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s <queue>", command)
+	}
+	queue := args[1]
+
+	var err error
+	switch command {
+	case "pause":
+		err = PauseQueue(conn, queue)
+	case "resume":
+		err = ResumeQueue(conn, queue)
+	case "drain":
+		err = DrainQueue(conn, queue)
+	default:
+		return fmt.Errorf("unknown command %q, expected pause, resume, drain or status", command)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Queue %s: %s\n", queue, command)
+	return nil
+}
+
+func printQueueStatus(conn redis.Conn, fetcher Fetcher) error {
+	states, err := QueueStates(conn)
+	if err != nil {
+		return err
+	}
+	known, err := redis.Strings(conn.Do("SMEMBERS", namespaced("queues")))
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, queue := range known {
+		names[queue] = true
+	}
+	for queue := range states {
+		names[queue] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for queue := range names {
+		sorted = append(sorted, queue)
+	}
+	sort.Strings(sorted)
+
+	fmt.Printf("%-20s %-10s %s\n", "QUEUE", "STATE", "SIZE")
+	for _, queue := range sorted {
+		state := states[queue]
+		if state == "" {
+			state = "running"
+		}
+
+		size, err := fetcher.Size(conn, queue)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-20s %-10s %d\n", queue, state, size)
+	}
+	return nil
+}
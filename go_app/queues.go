@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Queues is the list of queues a process consumes. Like Sidekiq, queues
+// declared without weights are checked in strict order, while weighted
+// queues are shuffled on every fetch so a queue with weight 2 is checked
+// first about twice as often as one with weight 1. A queue can also be
+// limited to a number of jobs running at once, in which case it is not
+// fetched from while it is at its limit.
+type Queues struct {
+	names    []string
+	weighted []string
+	strict   bool
+
+	limits    map[string]int
+	mu        sync.Mutex
+	running   map[string]int
+	paused    map[string]bool
+	available *sync.Cond
+}
+
+// ParseQueues reads a comma separated list of `name` or `name:weight`
+// entries, e.g. "chats:2,default:1".
+func ParseQueues(spec string) (*Queues, error) {
+	queues := &Queues{
+		strict:  true,
+		limits:  make(map[string]int),
+		running: make(map[string]int),
+		paused:  make(map[string]bool),
+	}
+	queues.available = sync.NewCond(&queues.mu)
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, weight := entry, 1
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			w, err := strconv.Atoi(entry[i+1:])
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight in queue %q", entry)
+			}
+			name, weight = entry[:i], w
+			queues.strict = false
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			queues.names = append(queues.names, name)
+		}
+		for i := 0; i < weight; i++ {
+			queues.weighted = append(queues.weighted, name)
+		}
+	}
+
+	if len(queues.names) == 0 {
+		return nil, fmt.Errorf("no queues given in %q", spec)
+	}
+	return queues, nil
+}
+
+// Names returns the queues in the order they were declared.
+func (queues *Queues) Names() []string {
+	return queues.names
+}
+
+// SetLimits reads a comma separated list of `name:limit` entries, e.g.
+// "default:3", capping how many jobs of a queue run at the same time.
+func (queues *Queues) SetLimits(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, ":")
+		if i < 0 {
+			return fmt.Errorf("missing limit in queue %q", entry)
+		}
+		limit, err := strconv.Atoi(entry[i+1:])
+		if err != nil || limit < 1 {
+			return fmt.Errorf("invalid limit in queue %q", entry)
+		}
+		queues.limits[entry[:i]] = limit
+	}
+	return nil
+}
+
+// Ordered returns the Redis keys, as built by key, of the queues in the
+// order they should be checked for the next fetch, leaving out queues that
+// are paused or at their limit. It blocks while no queue is left.
+func (queues *Queues) Ordered(key func(name string) string) []string {
+	names := queues.names
+	if !queues.strict {
+		names = shuffleUnique(queues.weighted)
+	}
+
+	queues.mu.Lock()
+	defer queues.mu.Unlock()
+
+	for {
+		var keys []string
+		for _, name := range names {
+			if queues.paused[name] {
+				continue
+			}
+			if limit, ok := queues.limits[name]; ok && queues.running[name] >= limit {
+				continue
+			}
+			keys = append(keys, key(name))
+		}
+		if len(keys) > 0 {
+			return keys
+		}
+		queues.available.Wait()
+	}
+}
+
+// SetPaused replaces the set of queues not to fetch from.
+func (queues *Queues) SetPaused(paused map[string]bool) {
+	queues.mu.Lock()
+	defer queues.mu.Unlock()
+
+	queues.paused = paused
+	queues.available.Broadcast()
+}
+
+// Acquire counts a fetched job against its queue's limit.
+func (queues *Queues) Acquire(name string) {
+	queues.mu.Lock()
+	defer queues.mu.Unlock()
+
+	queues.running[name]++
+}
+
+// Release frees the slot taken by Acquire once the job is done.
+func (queues *Queues) Release(name string) {
+	queues.mu.Lock()
+	defer queues.mu.Unlock()
+
+	queues.running[name]--
+	queues.available.Broadcast()
+}
+
+func shuffleUnique(weighted []string) []string {
+	shuffled := make([]string, len(weighted))
+	copy(shuffled, weighted)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	seen := make(map[string]bool)
+	unique := shuffled[:0]
+	for _, name := range shuffled {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQueues(t *testing.T) {
+	tests := []struct {
+		spec     string
+		names    []string
+		weighted []string
+		strict   bool
+		err      bool
+	}{
+		{spec: "default", names: []string{"default"}, weighted: []string{"default"}, strict: true},
+		{spec: "chats, default", names: []string{"chats", "default"}, weighted: []string{"chats", "default"}, strict: true},
+		{spec: "chats:2,default:1", names: []string{"chats", "default"}, weighted: []string{"chats", "chats", "default"}},
+		{spec: "default,default", names: []string{"default"}, weighted: []string{"default", "default"}, strict: true},
+		{spec: "a:b:3", names: []string{"a:b"}, weighted: []string{"a:b", "a:b", "a:b"}},
+		{spec: "default,", names: []string{"default"}, weighted: []string{"default"}, strict: true},
+		{spec: "", err: true},
+		{spec: " , ", err: true},
+		{spec: "default:0", err: true},
+		{spec: "default:x", err: true},
+	}
+
+	for _, test := range tests {
+		queues, err := ParseQueues(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseQueues(%q) succeeded, want an error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQueues(%q): %s", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(queues.Names(), test.names) || !reflect.DeepEqual(queues.weighted, test.weighted) || queues.strict != test.strict {
+			t.Errorf("ParseQueues(%q) = %v %v strict=%v, want %v %v strict=%v",
+				test.spec, queues.Names(), queues.weighted, queues.strict, test.names, test.weighted, test.strict)
+		}
+	}
+}
+
+func TestQueuesOrdered(t *testing.T) {
+	queues, err := ParseQueues("chats,default,mailers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queues.SetLimits("default:1"); err != nil {
+		t.Fatal(err)
+	}
+	queues.SetPaused(map[string]bool{"mailers": true})
+
+	key := func(name string) string { return "queue:" + name }
+	if got, want := queues.Ordered(key), []string{"queue:chats", "queue:default"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ordered() = %v, want %v", got, want)
+	}
+
+	queues.Acquire("default")
+	if got, want := queues.Ordered(key), []string{"queue:chats"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ordered() at the limit = %v, want %v", got, want)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	for _, spec := range []string{"default", "default:0", "default:x"} {
+		queues, _ := ParseQueues("default")
+		if err := queues.SetLimits(spec); err == nil {
+			t.Errorf("SetLimits(%q) succeeded, want an error", spec)
+		}
+	}
+}
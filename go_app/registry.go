@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// WorkerOptions declares a worker class to the consumer, the way a Ruby
+// worker declares itself with `sidekiq_options`.
+type WorkerOptions struct {
+	// Class is the class name jobs are pushed with, e.g. the Sidekiq worker
+	// or the ActiveJob class the Go worker stands in for.
+	Class string
+
+	// Queue is where jobs of the class are enqueued, "default" when empty.
+	Queue string
+
+	// Retry is the `retry` option for jobs pushed without one: true, false
+	// or a number of attempts.
+	Retry interface{}
+
+	// Timeout is the longest a job of the class may run, 0 for no limit.
+	// The context passed to Perform is cancelled once it is up.
+	Timeout time.Duration
+
+	// Concurrency caps how many jobs of the class this process runs at
+	// once, 0 for no cap.
+	Concurrency int
+
+	// Args is the worker's argument struct, whose `arg` tags are the
+	// schema jobs are decoded and validated against before New is called
+	// with a pointer to a decoded copy and the process's services.
+	Args interface{}
+	New  func(job Job, args interface{}, services *Services) Worker
+
+	// Lane, when set, orders the class's jobs, see LaneFunc.
+	Lane LaneFunc
+}
+
+var registry = make(map[string]*WorkerOptions)
+
+// registryOrder keeps the classes in the order they were registered.
+var registryOrder []string
+
+// RegisterWorker adds a worker class to the registry. Workers register
+// themselves from an init function; it panics on an incomplete or
+// duplicate registration, as those are programming errors.
+func RegisterWorker(options WorkerOptions) {
+	if options.Class == "" || options.New == nil {
+		panic("RegisterWorker: class and New are required")
+	}
+	if options.Args == nil || reflect.TypeOf(options.Args).Kind() != reflect.Struct {
+		panic(fmt.Sprintf("RegisterWorker: %s: Args must be a struct", options.Class))
+	}
+	if _, ok := registry[options.Class]; ok {
+		panic(fmt.Sprintf("RegisterWorker: %s registered twice", options.Class))
+	}
+	if options.Queue == "" {
+		options.Queue = "default"
+	}
+
+	registry[options.Class] = &options
+	registryOrder = append(registryOrder, options.Class)
+}
+
+// registeredWorkers returns the registered workers in registration order.
+func registeredWorkers() []*WorkerOptions {
+	workers := make([]*WorkerOptions, len(registryOrder))
+	for i, class := range registryOrder {
+		workers[i] = registry[class]
+	}
+	return workers
+}
+
+// RegisteredQueues lists the queues of the registered workers, each once.
+func RegisteredQueues() []string {
+	var queues []string
+	seen := make(map[string]bool)
+	for _, options := range registeredWorkers() {
+		if !seen[options.Queue] {
+			seen[options.Queue] = true
+			queues = append(queues, options.Queue)
+		}
+	}
+	return queues
+}
+
+// defaultQueue is the queue for a job of class pushed without one.
+func defaultQueue(class string) string {
+	if options, ok := registry[class]; ok {
+		return options.Queue
+	}
+	return "default"
+}
+
+// factory decodes a job's arguments against the schema and builds the
+// worker for it.
+func (options *WorkerOptions) factory(job Job, services *Services) (Worker, error) {
+	args := reflect.New(reflect.TypeOf(options.Args)).Interface()
+	if err := DecodeArgs(job, args); err != nil {
+		return nil, err
+	}
+	return options.New(job, args, services), nil
+}
+
+// applyDefaults gives a job the registered options it was pushed without.
+func (options *WorkerOptions) applyDefaults(job *Job) error {
+	if job.Retry == nil && options.Retry != nil {
+		// Set goes through JSON, so numbers end up as float64 like in a
+		// fetched payload.
+		return job.Set("retry", options.Retry)
+	}
+	return nil
+}
+
+// workerInfo is what the process publishes about a worker in its Sidekiq
+// process info, readable as `process["workers"]` from Sidekiq::ProcessSet.
+type workerInfo struct {
+	Queue       string      `json:"queue"`
+	Retry       interface{} `json:"retry,omitempty"`
+	Timeout     float64     `json:"timeout,omitempty"`
+	Concurrency int         `json:"concurrency,omitempty"`
+	Args        []string    `json:"args"`
+}
+
+func registryInfo() map[string]workerInfo {
+	info := make(map[string]workerInfo)
+	for _, options := range registeredWorkers() {
+		var args []string
+		for _, field := range argSchema(reflect.TypeOf(options.Args)) {
+			args = append(args, field.name)
+		}
+		info[options.Class] = workerInfo{
+			Queue:       options.Queue,
+			Retry:       options.Retry,
+			Timeout:     options.Timeout.Seconds(),
+			Concurrency: options.Concurrency,
+			Args:        args,
+		}
+	}
+	return info
+}
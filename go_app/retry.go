@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Sidekiq's default when a job is enqueued with `retry: true`.
+const defaultMaxRetries = 25
+
+// maxRetries reads the `retry` option the same way Sidekiq does: true means
+// the default number of attempts and an integer sets the limit explicitly.
+// Only false (or no option at all) turns retry handling off; `retry: 0` is
+// truthy in Ruby, so such a job goes straight to the morgue on failure.
+func (job *Job) maxRetries() (int, bool) {
+	switch retry := job.Retry.(type) {
+	case bool:
+		if retry {
+			return defaultMaxRetries, true
+		}
+	case float64:
+		if retry < 0 {
+			return 0, true
+		}
+		return int(retry), true
+	}
+	return 0, false
+}
+
+// retryDelay is Sidekiq's backoff: count^4 + 15 + rand(10) * (count + 1) seconds.
+func retryDelay(count int) time.Duration {
+	seconds := math.Pow(float64(count), 4) + 15 + float64(rand.Intn(10)*(count+1))
+	return time.Duration(seconds) * time.Second
+}
+
+// backtraceLines returns the stack of a panicked job when the job asked for
+// backtraces with `backtrace: true` or `backtrace: <lines>`.
+func (job *Job) backtraceLines(failure error) []string {
+	limit := -1
+	switch backtrace := job.Backtrace.(type) {
+	case bool:
+		if !backtrace {
+			return nil
+		}
+	case float64:
+		limit = int(backtrace)
+	default:
+		return nil
+	}
+
+	var panicErr *PanicError
+	if !errors.As(failure, &panicErr) {
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(panicErr.Stack)), "\n")
+	if limit >= 0 && len(lines) > limit {
+		lines = lines[:limit]
+	}
+	return lines
+}
+
+// compressBacktrace stores a backtrace the way Sidekiq's
+// compress_backtrace does: zlib deflated JSON, base64 encoded.
+func compressBacktrace(lines []string) (string, error) {
+	serialized, err := dumpJSON(lines)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	writer := zlib.NewWriter(&buf)
+	if _, err := writer.Write(serialized); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func errorClass(err error) string {
+	return fmt.Sprintf("%T", err)
+}
+
+func epoch(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// RetryJob records the failure on the job and schedules it in the Sidekiq
+// retry set so it shows up (and can be re-run) from Sidekiq::Web.
+func RetryJob(conn redis.Conn, job Job, failure error) error {
+	maxRetries, ok := job.maxRetries()
+	if !ok {
+		job.Logf("discarding job: retries disabled")
+		return nil
+	}
+
+	now := time.Now()
+	count := 0
+	if job.RetryCount != nil {
+		count = *job.RetryCount + 1
+		job.RetriedAt = epoch(now)
+	} else {
+		job.FailedAt = epoch(now)
+	}
+	job.RetryCount = &count
+	job.ErrorMessage = failure.Error()
+	job.ErrorClass = errorClass(failure)
+	if lines := job.backtraceLines(failure); lines != nil {
+		if compressed, err := compressBacktrace(lines); err == nil {
+			job.ErrorBacktrace = compressed
+		}
+	}
+	if job.RetryQueue != "" {
+		job.Queue = job.RetryQueue
+	}
+
+	if count >= maxRetries {
+		return retriesExhausted(conn, job)
+	}
+
+	payload, err := dumpJSON(job)
+	if err != nil {
+		return err
+	}
+
+	delay := retryDelay(count)
+	if _, err := conn.Do("ZADD", namespaced("retry"), epoch(now.Add(delay)), payload); err != nil {
+		return err
+	}
+
+	job.Logf("retrying in %s", delay)
+	return nil
+}
+
+// retriesExhausted sends the job to the morgue unless it was enqueued with
+// `dead: false`, in which case it is dropped like Sidekiq does.
+func retriesExhausted(conn redis.Conn, job Job) error {
+	if job.Dead != nil && !*job.Dead {
+		job.Logf("discarding job: %s", job.ErrorMessage)
+		return nil
+	}
+	return KillJob(conn, job)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Sorted sets holding jobs that become due at their score, in the order
+// Sidekiq::Scheduled::Enq checks them.
+var scheduledSets = []string{"retry", "schedule"}
+
+// Sidekiq's average_scheduled_poll_interval.
+const pollInterval = 5 * time.Second
+
+// PollScheduledJobs periodically moves due jobs from the retry and schedule
+// sets onto their queues, so `perform_in`/`perform_at` jobs and retries
+// reach ListenForJobs. Every move is a WATCH/MULTI transaction, so several
+// Go instances can poll the same sets without enqueueing a job twice. It
+// stops once done is closed.
+func PollScheduledJobs(pool *redis.Pool, fetcher Fetcher, done chan struct{}) {
+	for {
+		// Randomize the wait so several processes don't poll in lockstep.
+		select {
+		case <-time.After(pollInterval/2 + time.Duration(rand.Int63n(int64(pollInterval)))):
+		case <-done:
+			return
+		}
+
+		conn := pool.Get()
+		if err := enqueueScheduledJobs(conn, fetcher, time.Now()); err != nil {
+			fmt.Printf("Scheduled poller failed: %s\n", err)
+		}
+		conn.Close()
+	}
+}
+
+func enqueueScheduledJobs(conn redis.Conn, fetcher Fetcher, now time.Time) error {
+	for _, set := range scheduledSets {
+		for {
+			moved, err := enqueueNextScheduledJob(conn, fetcher, namespaced(set), now)
+			if err != nil {
+				return err
+			}
+			if !moved {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// enqueueNextScheduledJob moves the oldest due job of the set onto its
+// queue. It reports false once there is nothing left to move.
+func enqueueNextScheduledJob(conn redis.Conn, fetcher Fetcher, set string, now time.Time) (bool, error) {
+	if _, err := conn.Do("WATCH", set); err != nil {
+		return false, err
+	}
+
+	due, err := redis.ByteSlices(conn.Do("ZRANGEBYSCORE", set, "-inf", epoch(now), "LIMIT", 0, 1))
+	if err != nil || len(due) == 0 {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+	payload := due[0]
+
+	queue, enqueued, err := prepareScheduledJob(payload, now)
+	if err != nil {
+		fmt.Printf("Killing unreadable job from %s: %s\n", set, err)
+		conn.Send("MULTI")
+		conn.Send("ZREM", set, payload)
+		sendKillPayload(conn, payload, now)
+		if _, err := conn.Do("EXEC"); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", set, payload)
+	fetcher.Push(conn, queue, enqueued)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return false, err
+	}
+
+	// A nil EXEC reply means another process touched the set first; either
+	// way there may be more due jobs, so keep going.
+	return true, nil
+}
+
+// prepareScheduledJob stamps a fresh enqueued_at on the payload like
+// Sidekiq::Client#push does, leaving every other key untouched.
+func prepareScheduledJob(payload []byte, now time.Time) (string, []byte, error) {
+	var job Job
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return "", nil, err
+	}
+
+	if job.Queue == "" {
+		job.Queue = defaultQueue(job.Class)
+	}
+	job.EnqueuedAt = epoch(now)
+
+	enqueued, err := dumpJSON(job)
+	return job.Queue, enqueued, err
+}
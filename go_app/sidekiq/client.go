@@ -0,0 +1,180 @@
+// Package sidekiq pushes jobs to Redis in exactly the format Ruby's
+// Sidekiq::Client does, so Sidekiq and the Go consumer both run them.
+package sidekiq
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Job is a job to push. Only Class is required; Retry defaults to true and
+// Queue to "default", like Sidekiq's default worker options.
+type Job struct {
+	Retry      interface{}   `json:"retry"`
+	Queue      string        `json:"queue"`
+	Backtrace  interface{}   `json:"backtrace,omitempty"`
+	Dead       *bool         `json:"dead,omitempty"`
+	RetryQueue string        `json:"retry_queue,omitempty"`
+	Tags       []string      `json:"tags,omitempty"`
+	Class      string        `json:"class"`
+	Args       []interface{} `json:"args"`
+	Jid        string        `json:"jid"`
+	CreatedAt  float64       `json:"created_at"`
+	EnqueuedAt float64       `json:"enqueued_at,omitempty"`
+
+	// At schedules the job instead of enqueueing it right away.
+	At time.Time `json:"-"`
+}
+
+// Client pushes jobs through a Redis pool, prefixing keys with the
+// namespace Sidekiq is configured with (e.g. "instachat"), if any.
+type Client struct {
+	pool      *redis.Pool
+	namespace string
+}
+
+func NewClient(pool *redis.Pool, namespace string) *Client {
+	return &Client{pool: pool, namespace: namespace}
+}
+
+// PerformAsync enqueues a job, like `Worker.perform_async(*args)`.
+func (client *Client) PerformAsync(class string, args ...interface{}) (string, error) {
+	return client.Push(Job{Class: class, Args: args})
+}
+
+// PerformIn schedules a job to run after the delay, like `perform_in`.
+func (client *Client) PerformIn(delay time.Duration, class string, args ...interface{}) (string, error) {
+	return client.Push(Job{Class: class, Args: args, At: time.Now().Add(delay)})
+}
+
+// PerformAt schedules a job to run at the given time, like `perform_at`.
+func (client *Client) PerformAt(at time.Time, class string, args ...interface{}) (string, error) {
+	return client.Push(Job{Class: class, Args: args, At: at})
+}
+
+// Push enqueues a single job and returns its jid.
+func (client *Client) Push(job Job) (string, error) {
+	jids, err := client.PushBulk(job, [][]interface{}{job.Args})
+	if err != nil {
+		return "", err
+	}
+	return jids[0], nil
+}
+
+// PushBulk enqueues one job per argument list in a single round trip, like
+// `Sidekiq::Client.push_bulk`. Every job gets its own jid.
+func (client *Client) PushBulk(job Job, args [][]interface{}) ([]string, error) {
+	batch, err := newBatch(job, args, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	conn := client.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	client.send(conn, batch)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, err
+	}
+	return batch.jids, nil
+}
+
+// batch is jobs ready to push: their jids and payloads, the queue they go
+// to and, for scheduled jobs, when they run.
+type batch struct {
+	queue    string
+	at       time.Time
+	jids     []string
+	payloads [][]byte
+}
+
+// newBatch builds the payloads of a bulk push as of now. Scheduled jobs get
+// no `enqueued_at` until the scheduler enqueues them, and their time is
+// only kept as the schedule's score.
+func newBatch(job Job, args [][]interface{}, now time.Time) (*batch, error) {
+	if job.Class == "" {
+		return nil, errors.New("job class is required")
+	}
+	if job.Retry == nil {
+		job.Retry = true
+	}
+	if job.Queue == "" {
+		job.Queue = "default"
+	}
+
+	batch := &batch{queue: job.Queue, jids: make([]string, len(args)), payloads: make([][]byte, len(args))}
+	if !job.At.IsZero() && job.At.After(now) {
+		batch.at = job.At
+	}
+
+	for i, jobArgs := range args {
+		item := job
+		item.Args = jobArgs
+		if item.Args == nil {
+			item.Args = []interface{}{}
+		}
+		item.Jid = newJid()
+		item.CreatedAt = epoch(now)
+		if batch.at.IsZero() {
+			item.EnqueuedAt = epoch(now)
+		}
+
+		payload, err := dumpJSON(item)
+		if err != nil {
+			return nil, err
+		}
+		batch.jids[i] = item.Jid
+		batch.payloads[i] = payload
+	}
+	return batch, nil
+}
+
+// send queues the commands that push the batch, for the caller to run in
+// a transaction.
+func (client *Client) send(conn redis.Conn, batch *batch) {
+	if !batch.at.IsZero() {
+		for _, payload := range batch.payloads {
+			conn.Send("ZADD", client.key("schedule"), epoch(batch.at), payload)
+		}
+		return
+	}
+	conn.Send("SADD", client.key("queues"), batch.queue)
+	conn.Send("LPUSH", redis.Args{}.Add(client.key("queue:"+batch.queue)).AddFlat(batch.payloads)...)
+}
+
+func (client *Client) key(key string) string {
+	if client.namespace == "" {
+		return key
+	}
+	return client.namespace + ":" + key
+}
+
+// newJid returns 12 random bytes in hex, like SecureRandom.hex(12).
+func newJid() string {
+	jid := make([]byte, 12)
+	rand.Read(jid)
+	return hex.EncodeToString(jid)
+}
+
+func epoch(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// dumpJSON encodes payloads the way Ruby's JSON.generate does, without
+// escaping <, > and & into \u sequences.
+func dumpJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
@@ -0,0 +1,168 @@
+package sidekiq
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var jidPattern = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+func TestNewBatch(t *testing.T) {
+	now := time.Unix(1602850000, 500000000)
+	later := now.Add(time.Minute)
+	no := false
+
+	tests := []struct {
+		name string
+		job  Job
+		args [][]interface{}
+		at   time.Time
+		want []string
+	}{
+		{
+			name: "defaults",
+			job:  Job{Class: "HardWorker"},
+			args: [][]interface{}{{1, "hi"}},
+			want: []string{`{"retry":true,"queue":"default","class":"HardWorker","args":[1,"hi"],"jid":"JID","created_at":1602850000.5,"enqueued_at":1602850000.5}`},
+		},
+		{
+			name: "nil args",
+			job:  Job{Class: "HardWorker"},
+			args: [][]interface{}{nil},
+			want: []string{`{"retry":true,"queue":"default","class":"HardWorker","args":[],"jid":"JID","created_at":1602850000.5,"enqueued_at":1602850000.5}`},
+		},
+		{
+			name: "options",
+			job:  Job{Class: "HardWorker", Queue: "chats", Retry: 3, Dead: &no, RetryQueue: "low", Tags: []string{"a"}, Backtrace: true},
+			args: [][]interface{}{{"a&<b>"}},
+			want: []string{`{"retry":3,"queue":"chats","backtrace":true,"dead":false,"retry_queue":"low","tags":["a"],"class":"HardWorker","args":["a&<b>"],"jid":"JID","created_at":1602850000.5,"enqueued_at":1602850000.5}`},
+		},
+		{
+			name: "scheduled",
+			job:  Job{Class: "HardWorker", At: later},
+			args: [][]interface{}{{1}},
+			at:   later,
+			want: []string{`{"retry":true,"queue":"default","class":"HardWorker","args":[1],"jid":"JID","created_at":1602850000.5}`},
+		},
+		{
+			name: "scheduled in the past",
+			job:  Job{Class: "HardWorker", At: now.Add(-time.Minute)},
+			args: [][]interface{}{{1}},
+			want: []string{`{"retry":true,"queue":"default","class":"HardWorker","args":[1],"jid":"JID","created_at":1602850000.5,"enqueued_at":1602850000.5}`},
+		},
+		{
+			name: "bulk",
+			job:  Job{Class: "HardWorker"},
+			args: [][]interface{}{{1}, {2}},
+			want: []string{
+				`{"retry":true,"queue":"default","class":"HardWorker","args":[1],"jid":"JID","created_at":1602850000.5,"enqueued_at":1602850000.5}`,
+				`{"retry":true,"queue":"default","class":"HardWorker","args":[2],"jid":"JID","created_at":1602850000.5,"enqueued_at":1602850000.5}`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch, err := newBatch(test.job, test.args, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !batch.at.Equal(test.at) {
+				t.Errorf("at = %s, want %s", batch.at, test.at)
+			}
+
+			seen := make(map[string]bool)
+			for i, payload := range batch.payloads {
+				jid := batch.jids[i]
+				if !jidPattern.MatchString(jid) || seen[jid] {
+					t.Errorf("jid %q is not a new 24 character hex string", jid)
+				}
+				seen[jid] = true
+
+				got := regexp.MustCompile(`"jid":"`+jid+`"`).ReplaceAllString(string(payload), `"jid":"JID"`)
+				if got != test.want[i] {
+					t.Errorf("payload\n got: %s\nwant: %s", got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNewBatchRequiresClass(t *testing.T) {
+	if _, err := newBatch(Job{}, [][]interface{}{{1}}, time.Now()); err == nil {
+		t.Error("no error for a job without a class")
+	}
+}
+
+// recordingConn records the commands sent to it.
+type recordingConn struct {
+	commands []string
+}
+
+func (conn *recordingConn) Close() error { return nil }
+func (conn *recordingConn) Err() error   { return nil }
+func (conn *recordingConn) Flush() error { return nil }
+
+func (conn *recordingConn) Do(command string, args ...interface{}) (interface{}, error) {
+	return nil, conn.Send(command, args...)
+}
+
+func (conn *recordingConn) Send(command string, args ...interface{}) error {
+	line := command
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			line += " " + string(arg)
+		default:
+			line += fmt.Sprint(" ", arg)
+		}
+	}
+	conn.commands = append(conn.commands, line)
+	return nil
+}
+
+func (conn *recordingConn) Receive() (interface{}, error) { return nil, nil }
+
+func TestClientSend(t *testing.T) {
+	at := time.Unix(1602850060, 0)
+
+	tests := []struct {
+		name      string
+		namespace string
+		batch     *batch
+		want      []string
+	}{
+		{
+			name:      "enqueue",
+			namespace: "instachat",
+			batch:     &batch{queue: "default", payloads: [][]byte{[]byte("a"), []byte("b")}},
+			// LPUSH with several values pushes them in order, so the last
+			// payload ends up at the head, as with Sidekiq's push_bulk.
+			want: []string{"SADD instachat:queues default", "LPUSH instachat:queue:default a b"},
+		},
+		{
+			name:  "without namespace",
+			batch: &batch{queue: "chats", payloads: [][]byte{[]byte("a")}},
+			want:  []string{"SADD queues chats", "LPUSH queue:chats a"},
+		},
+		{
+			name:      "schedule",
+			namespace: "instachat",
+			batch:     &batch{queue: "default", at: at, payloads: [][]byte{[]byte("a"), []byte("b")}},
+			want:      []string{"ZADD instachat:schedule 1.60285006e+09 a", "ZADD instachat:schedule 1.60285006e+09 b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &recordingConn{}
+			NewClient(nil, test.namespace).send(conn, test.batch)
+			if !reflect.DeepEqual(conn.commands, test.want) {
+				t.Errorf("sent %q, want %q", conn.commands, test.want)
+			}
+		})
+	}
+}
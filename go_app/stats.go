@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Sidekiq keeps the per-day counters for five years.
+const statsTTL = 5 * 365 * 24 * 60 * 60
+
+// RecordStats counts a performed job in the totals and daily counters that
+// drive the Sidekiq::Web dashboard. Like Sidekiq, failed jobs count as
+// processed too.
+func RecordStats(conn redis.Conn, failed bool) error {
+	date := time.Now().UTC().Format("2006-01-02")
+
+	stats := []string{"processed"}
+	if failed {
+		stats = append(stats, "failed")
+	}
+
+	for _, stat := range stats {
+		daily := namespaced("stat:" + stat + ":" + date)
+		conn.Send("INCRBY", namespaced("stat:"+stat), 1)
+		conn.Send("INCRBY", daily, 1)
+		conn.Send("EXPIRE", daily, statsTTL)
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(stats)*3; i++ {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
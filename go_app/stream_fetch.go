@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The consumer group every Go instance reads the streams with.
+const streamGroup = namespace + "-go"
+
+// Streams are capped at about this many entries, so acknowledged jobs stay
+// around for replay for a while without growing without bound.
+const streamMaxLen = 100000
+
+// Entries pending for longer than this are considered abandoned by a
+// crashed consumer and claimed by the next one that checks, as many at a
+// time as it runs jobs at once, so it gets through them well inside the
+// idle time.
+const (
+	streamClaimIdle     = 5 * time.Minute
+	streamClaimInterval = 30 * time.Second
+)
+
+// Reads block for less time than list fetches, since jobs pushed onto the
+// lists are only moved into the streams between reads.
+const (
+	streamBlock       = 500 * time.Millisecond
+	streamBridgeBatch = 100
+)
+
+// bridgeListScript moves jobs from a queue's list, where Rails and other
+// Sidekiq clients LPUSH them, into its stream, oldest first.
+var bridgeListScript = redis.NewScript(2, `
+local list, stream, maxlen, batch = KEYS[1], KEYS[2], ARGV[1], tonumber(ARGV[2])
+local moved = 0
+while moved < batch do
+  local payload = redis.call('rpop', list)
+  if not payload then
+    break
+  end
+  redis.call('xadd', stream, 'MAXLEN', '~', maxlen, '*', 'payload', payload)
+  moved = moved + 1
+end
+return moved
+`)
+
+// streamFetch consumes `stream:<queue>` Redis Streams through a consumer
+// group. Every job stays in this consumer's pending list until it is
+// acknowledged with XACK, and entries left pending by dead consumers are
+// taken over with XAUTOCLAIM, which gives at-least-once delivery. Jobs are
+// added with XADD under a `payload` field, as Push does; jobs that
+// producers still push onto the Sidekiq lists are moved into the streams
+// before every read. Requires Redis 6.2 or later.
+type streamFetch struct {
+	queues    *Queues
+	group     string
+	consumer  string
+	lastClaim time.Time
+
+	// claimBatch is how many abandoned entries are claimed at a time.
+	claimBatch int
+
+	// fetched holds entries delivered to this consumer but not returned by
+	// Fetch yet, as a read or a claim can deliver several at once. Release
+	// gives them back on shutdown.
+	fetched []fetchedEntry
+}
+
+type fetchedEntry struct {
+	job Job
+	err error
+}
+
+func streamKey(name string) string {
+	return namespaced("stream:" + name)
+}
+
+func NewStreamFetch(pool *redis.Pool, queues *Queues, group string, claimBatch int) (Fetcher, error) {
+	fetch := &streamFetch{queues: queues, group: group, consumer: identity, claimBatch: claimBatch}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	for _, name := range queues.Names() {
+		_, err := conn.Do("XGROUP", "CREATE", streamKey(name), group, "0", "MKSTREAM")
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, err
+		}
+	}
+	return fetch, nil
+}
+
+func (fetch *streamFetch) Fetch(conn redis.Conn) (Job, error) {
+	if len(fetch.fetched) == 0 {
+		if err := fetch.fill(conn); err != nil {
+			return Job{}, err
+		}
+	}
+	if len(fetch.fetched) == 0 {
+		return Job{}, redis.ErrNil
+	}
+
+	next := fetch.fetched[0]
+	fetch.fetched = fetch.fetched[1:]
+	return next.job, next.err
+}
+
+// fill claims abandoned entries when it is time to, and otherwise bridges
+// the lists and reads new entries. The streams are read one at a time in
+// priority order; only when all are empty does it block on every stream,
+// and entries arriving during that wait may come from several queues at
+// once.
+func (fetch *streamFetch) fill(conn redis.Conn) error {
+	streams := fetch.queues.Ordered(streamKey)
+
+	if time.Since(fetch.lastClaim) > streamClaimInterval {
+		fetch.lastClaim = time.Now()
+		for _, stream := range streams {
+			if len(fetch.fetched) >= fetch.claimBatch {
+				break
+			}
+			if err := fetch.claim(conn, stream, fetch.claimBatch-len(fetch.fetched)); err != nil {
+				return err
+			}
+		}
+		if len(fetch.fetched) > 0 {
+			return nil
+		}
+	}
+
+	if err := fetch.bridgeLists(conn); err != nil {
+		return err
+	}
+
+	for _, stream := range streams {
+		if err := fetch.read(conn, redis.Args{"STREAMS", stream, ">"}); err != nil {
+			return err
+		}
+		if len(fetch.fetched) > 0 {
+			return nil
+		}
+	}
+
+	args := redis.Args{"BLOCK", int64(streamBlock / time.Millisecond), "STREAMS"}
+	args = args.AddFlat(streams)
+	for range streams {
+		args = args.Add(">")
+	}
+	return fetch.read(conn, args)
+}
+
+// read runs XREADGROUP for one new entry per stream.
+func (fetch *streamFetch) read(conn redis.Conn, streams redis.Args) error {
+	args := redis.Args{"GROUP", fetch.group, fetch.consumer, "COUNT", 1}
+	reply, err := redis.Values(conn.Do("XREADGROUP", append(args, streams...)...))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// [[stream, [[id, [field, value, ...]]]], ...]
+	for _, item := range reply {
+		streamReply, err := redis.Values(item, nil)
+		if err != nil || len(streamReply) != 2 {
+			continue
+		}
+		stream, _ := redis.String(streamReply[0], nil)
+		entries, _ := redis.Values(streamReply[1], nil)
+		for _, entry := range entries {
+			job, err := streamEntryJob(stream, entry)
+			fetch.fetched = append(fetch.fetched, fetchedEntry{job, err})
+		}
+	}
+	return nil
+}
+
+// bridgeLists moves the jobs waiting in the queues' lists into their
+// streams.
+func (fetch *streamFetch) bridgeLists(conn redis.Conn) error {
+	for _, name := range fetch.queues.Names() {
+		if _, err := bridgeListScript.Do(conn, queueKey(name), streamKey(name), streamMaxLen, streamBridgeBatch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim takes over up to count of the stream's entries that have been
+// pending for too long.
+func (fetch *streamFetch) claim(conn redis.Conn, stream string, count int) error {
+	reply, err := redis.Values(conn.Do("XAUTOCLAIM", stream, fetch.group, fetch.consumer,
+		int64(streamClaimIdle/time.Millisecond), "0-0", "COUNT", count))
+	if err != nil {
+		return err
+	}
+	if len(reply) < 2 {
+		return nil
+	}
+
+	entries, _ := redis.Values(reply[1], nil)
+	for _, entry := range entries {
+		// Entries deleted while pending are claimed as nil.
+		if entry == nil {
+			continue
+		}
+		job, err := streamEntryJob(stream, entry)
+		if err == nil {
+			fmt.Printf("Claimed abandoned job %s(%s) from %s\n", job.Class, job.Jid, stream)
+		}
+		fetch.fetched = append(fetch.fetched, fetchedEntry{job, err})
+	}
+	return nil
+}
+
+func streamEntryJob(stream string, entry interface{}) (Job, error) {
+	values, err := redis.Values(entry, nil)
+	if err != nil || len(values) != 2 {
+		return Job{}, fmt.Errorf("unexpected stream entry in %s", stream)
+	}
+	id, _ := redis.String(values[0], nil)
+	fields, _ := redis.StringMap(values[1], nil)
+
+	// Malformed jobs still carry their id, so they can be acknowledged.
+	job, err := parseJob([]byte(fields["payload"]))
+	job.stream, job.streamID = stream, id
+	return job, err
+}
+
+func (fetch *streamFetch) Acknowledge(conn redis.Conn, job Job) error {
+	if job.streamID == "" {
+		return nil
+	}
+	_, err := conn.Do("XACK", job.stream, fetch.group, job.streamID)
+	return err
+}
+
+// Requeue adds the job to the end of its stream again and acknowledges the
+// entry it was fetched from, rather than waiting for it to be claimed.
+func (fetch *streamFetch) Requeue(conn redis.Conn, job Job) error {
+	conn.Send("MULTI")
+	fetch.Push(conn, job.Queue, job.payload)
+	if job.streamID != "" {
+		conn.Send("XACK", job.stream, fetch.group, job.streamID)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Release requeues the jobs that were delivered to this consumer but not
+// returned by Fetch, so they are not left pending until they are claimed.
+// Unreadable entries stay pending, to be killed by whoever claims them.
+func (fetch *streamFetch) Release(conn redis.Conn) error {
+	fetched := fetch.fetched
+	fetch.fetched = nil
+
+	for i, entry := range fetched {
+		if entry.err != nil {
+			continue
+		}
+		if err := fetch.Requeue(conn, entry.job); err != nil {
+			fetch.fetched = fetched[i:]
+			return err
+		}
+	}
+	return nil
+}
+
+func (fetch *streamFetch) Push(conn redis.Conn, queue string, payload []byte) {
+	conn.Send("SADD", namespaced("queues"), queue)
+	conn.Send("XADD", streamKey(queue), "MAXLEN", "~", streamMaxLen, "*", "payload", payload)
+}
+
+// Size is the jobs still waiting in the queue's list plus the consumer
+// group's lag: entries added to the stream but not delivered to any
+// consumer yet.
+func (fetch *streamFetch) Size(conn redis.Conn, queue string) (int64, error) {
+	waiting, err := listSize(conn, queue)
+	if err != nil {
+		return 0, err
+	}
+	lag, err := fetch.lag(conn, queue)
+	return waiting + lag, err
+}
+
+// lag falls back to the whole stream length on Redis before 7.0, which
+// does not report it.
+func (fetch *streamFetch) lag(conn redis.Conn, queue string) (int64, error) {
+	groups, err := redis.Values(conn.Do("XINFO", "GROUPS", streamKey(queue)))
+	if err != nil && strings.Contains(err.Error(), "no such key") {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, group := range groups {
+		info, err := redis.Values(group, nil)
+		if err != nil {
+			return 0, err
+		}
+		fields := make(map[string]interface{})
+		for i := 0; i+1 < len(info); i += 2 {
+			name, _ := redis.String(info[i], nil)
+			fields[name] = info[i+1]
+		}
+		if name, _ := redis.String(fields["name"], nil); name != fetch.group {
+			continue
+		}
+		if lag, err := redis.Int64(fields["lag"], nil); err == nil {
+			return lag, nil
+		}
+	}
+	return redis.Int64(conn.Do("XLEN", streamKey(queue)))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// TraceContext identifies the Rails request a job was enqueued from. It is
+// carried in the payload as a W3C `traceparent` ("00-<trace id>-<parent
+// id>-<flags>") next to the Rails `request_id`.
+type TraceContext struct {
+	TraceID   string
+	ParentID  string
+	Flags     string
+	RequestID string
+}
+
+var traceparentPattern = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// ParseTraceparent reads a traceparent header value, rejecting the all
+// zero ids the specification forbids.
+func ParseTraceparent(traceparent string) (TraceContext, bool) {
+	match := traceparentPattern.FindStringSubmatch(strings.TrimSpace(traceparent))
+	if match == nil || match[1] == "ff" || strings.Trim(match[2], "0") == "" || strings.Trim(match[3], "0") == "" {
+		return TraceContext{}, false
+	}
+	return TraceContext{TraceID: match[2], ParentID: match[3], Flags: match[4]}, true
+}
+
+// Trace returns the job's trace context. Jobs enqueued without one, like
+// those pushed before Rails started adding it, get a trace id derived from
+// their request id or jid, so all their log lines and retries still share
+// one id.
+func (job *Job) Trace() TraceContext {
+	var traceparent, requestID string
+	job.Get("traceparent", &traceparent)
+	job.Get("request_id", &requestID)
+
+	trace, ok := ParseTraceparent(traceparent)
+	if !ok {
+		id := strings.ToLower(strings.Replace(requestID, "-", "", -1))
+		if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+			id = fmt.Sprintf("%032s", job.Jid)
+		}
+		trace = TraceContext{TraceID: id, Flags: "00"}
+	}
+	trace.RequestID = requestID
+	return trace
+}
+
+// Traceparent is the header value for calls made while performing the
+// job: same trace, with this run of the job as the parent.
+func (job *Job) Traceparent() string {
+	trace := job.Trace()
+	spanID := job.spanID
+	if spanID == "" {
+		spanID = newSpanID()
+	}
+	return fmt.Sprintf("00-%s-%s-%s", trace.TraceID, spanID, trace.Flags)
+}
+
+// Logf logs a line for the job, tagged with its class, jid and trace id.
+func (job *Job) Logf(format string, args ...interface{}) {
+	trace := job.Trace()
+	prefix := fmt.Sprintf("%s JID-%s trace=%s", job.Class, job.Jid, trace.TraceID)
+	if trace.RequestID != "" {
+		prefix += " request_id=" + trace.RequestID
+	}
+	fmt.Printf("%s: %s\n", prefix, fmt.Sprintf(format, args...))
+}
+
+// SQLComment returns a comment in the sqlcommenter format to append to the
+// job's SQL, so slow query logs and the process list lead back to the
+// request.
+func (job *Job) SQLComment() string {
+	comment := fmt.Sprintf("traceparent='%s'", url.QueryEscape(job.Traceparent()))
+	if requestID := job.Trace().RequestID; requestID != "" {
+		comment += fmt.Sprintf(",request_id='%s'", url.QueryEscape(requestID))
+	}
+	return " /*" + comment + "*/"
+}
+
+// TraceRequest adds the job's trace headers to an outgoing HTTP request.
+func (job *Job) TraceRequest(request *http.Request) {
+	request.Header.Set("traceparent", job.Traceparent())
+	if requestID := job.Trace().RequestID; requestID != "" {
+		request.Header.Set("X-Request-Id", requestID)
+	}
+}
+
+// newSpanID returns a random id for one run of a job.
+func newSpanID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -1,5 +1,16 @@
 package main
 
+import "context"
+
+// Worker performs one job. ctx is cancelled once the job runs past its
+// class's timeout, and should be passed on to every database and HTTP call.
 type Worker interface {
-	Perform()
+	Perform(ctx context.Context) error
+}
+
+// Services are the long-lived resources the process shares with every
+// worker it builds.
+type Services struct {
+	Config *Config
+	DB     *Database
 }
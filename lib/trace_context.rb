@@ -0,0 +1,28 @@
+# frozen_string_literal: true
+
+# W3C trace context for the current request, handed on to the Go workers
+# through the Sidekiq job payload.
+class TraceContext
+  TRACEPARENT = /\A00-(?<trace_id>\h{32})-\h{16}-(?<flags>\h{2})\z/.freeze
+
+  class << self
+    # Continues the caller's trace when the request came with a
+    # traceparent header, and starts one from the request id otherwise.
+    def traceparent_for(request)
+      match = TRACEPARENT.match(request.headers['traceparent'].to_s.downcase)
+      trace_id = match ? match[:trace_id] : request.request_id.to_s.delete('-')
+      trace_id = SecureRandom.hex(16) unless trace_id.match?(/\A\h{32}\z/)
+      "00-#{trace_id}-#{SecureRandom.hex(8)}-#{match ? match[:flags] : '01'}"
+    end
+  end
+
+  # Sidekiq client middleware adding the trace context to every job pushed
+  # while handling a request.
+  class SidekiqMiddleware
+    def call(_worker_class, job, _queue, _redis_pool)
+      job['traceparent'] ||= Current.traceparent if Current.traceparent
+      job['request_id'] ||= Current.request_id if Current.request_id
+      yield
+    end
+  end
+end